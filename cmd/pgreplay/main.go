@@ -3,10 +3,16 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	stdlog "log"
 	"os"
+	"os/signal"
+	"regexp"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
@@ -22,29 +28,96 @@ var (
 	app = kingpin.New("pgreplay", "Replay Postgres logs against database").Version(versionStanza())
 
 	// Global flags applying to every command
-	debug          = app.Flag("debug", "Enable debug logging").Default("false").Bool()
-	startFlag      = app.Flag("start", "Play logs from this time onward ("+pgreplay.PostgresTimestampFormat+")").String()
-	finishFlag     = app.Flag("finish", "Stop playing logs at this time ("+pgreplay.PostgresTimestampFormat+")").String()
-	metricsAddress = app.Flag("metrics-address", "Address to bind HTTP metrics listener").Default("0.0.0.0").String()
-	metricsPort    = app.Flag("metrics-port", "Port to bind HTTP metrics listener").Default("9445").Uint16()
-
-	filter            = app.Command("filter", "Process an errlog file into a pgreplay preprocessed JSON log")
-	filterJsonInput   = filter.Flag("json-input", "JSON input file").ExistingFile()
-	filterErrlogInput = filter.Flag("errlog-input", "Postgres errlog input file").ExistingFile()
-	filterCsvLogInput = filter.Flag("csvlog-input", "Postgres CSV log input file").ExistingFile()
-	filterOutput      = filter.Flag("output", "JSON output file").String()
-	filterNullOutput  = filter.Flag("null-output", "Don't output anything, for testing parsing only").Bool()
-
-	run            = app.Command("run", "Replay from log files against a real database")
-	runHost        = run.Flag("host", "PostgreSQL database host").Required().String()
-	runPort        = run.Flag("port", "PostgreSQL database port").Default("5432").Uint16()
-	runDatname     = run.Flag("database", "PostgreSQL root database").Default("postgres").String()
-	runUser        = run.Flag("user", "PostgreSQL root user").Default("postgres").String()
-	runPassword    = run.Flag("password", "PostgreSQl password user (the default value is obtained from the DB_PASSWORD env var)").Default(os.Getenv("DB_PASSWORD")).String()
-	runReplayRate  = run.Flag("replay-rate", "Rate of playback, will execute queries at Nx speed").Default("1").Float()
-	runErrlogInput = run.Flag("errlog-input", "Path to PostgreSQL errlog").ExistingFile()
-	runCsvLogInput = run.Flag("csvlog-input", "Path to PostgreSQL CSV log").ExistingFile()
-	runJsonInput   = run.Flag("json-input", "Path to preprocessed pgreplay JSON log file").ExistingFile()
+	debug             = app.Flag("debug", "Enable debug logging").Default("false").Bool()
+	startFlag         = app.Flag("start", "Play logs from this time onward ("+pgreplay.PostgresTimestampFormat+")").String()
+	finishFlag        = app.Flag("finish", "Stop playing logs at this time ("+pgreplay.PostgresTimestampFormat+")").String()
+	metricsAddress    = app.Flag("metrics-address", "Address to bind HTTP metrics listener").Default("0.0.0.0").String()
+	metricsPort       = app.Flag("metrics-port", "Port to bind HTTP metrics listener").Default("9445").Uint16()
+	encryptionKeyFile = app.Flag("encryption-key-file", "File containing the key for encrypted JSON logs (the default value is obtained from the "+encryptionKeyEnv+" env var)").ExistingFile()
+	metricsWait       = app.Flag("metrics-shutdown-wait", "Time to keep serving metrics after finishing, allowing a final scrape").Default("5s").Duration()
+
+	filter                      = app.Command("filter", "Process an errlog file into a pgreplay preprocessed JSON log")
+	filterJsonInput             = filter.Flag("json-input", "JSON input file").ExistingFile()
+	filterErrlogInput           = filter.Flag("errlog-input", "Postgres errlog input file").ExistingFile()
+	filterCsvLogInput           = filter.Flag("csvlog-input", "Postgres CSV log input file").ExistingFile()
+	filterOutput                = filter.Flag("output", "JSON output file").String()
+	filterNullOutput            = filter.Flag("null-output", "Don't output anything, for testing parsing only").Bool()
+	filterEncryptOutput         = filter.Flag("encrypt-output", "Encrypt the output with the key from --encryption-key-file").Bool()
+	filterRules                 = filter.Flag("rules", "YAML file of rules to rewrite or drop items, may be repeated").ExistingFiles()
+	filterRulePresets           = filter.Flag("rules-preset", "Apply a built-in set of rules ("+strings.Join(pgreplay.RulePresetNames(), ", ")+"), may be repeated").Enums(pgreplay.RulePresetNames()...)
+	filterItemFilter            = itemFilterFlags(filter)
+	filterSample                = filter.Flag("sample-sessions", "Keep this fraction of sessions, chosen by a hash of their ID").Default("1").Float()
+	filterScale                 = filter.Flag("scale", "Replay each session this many times, cloning it with a new session ID").Default("1").Int()
+	filterScaleJitter           = filter.Flag("scale-jitter", "Delay each cloned session by up to this long").Default("1s").Duration()
+	filterTimeTransform         = timeTransformFlags(filter)
+	filterAnonymise             = filter.Flag("anonymise", "Pseudonymise string literals and bind parameters, keyed by --anonymise-key-file or "+anonymiseKeyEnv).Bool()
+	filterAnonymiseKeyFile      = filter.Flag("anonymise-key-file", "File containing the key for --anonymise").ExistingFile()
+	filterAnonymiseAllowColumns = filter.Flag("anonymise-allow-column", "Keep values compared with or inserted into this column, may be repeated").Strings()
+	filterAnonymiseAllowValues  = filter.Flag("anonymise-allow-value", "Keep values matching this regular expression, may be repeated").Strings()
+	filterTransactions          = filter.Flag("transactions", "Keep transactions as logged (keep), drop statements that control them (flatten), or drop transactions that failed originally (skip-failed)").Default(pgreplay.TransactionsKeep).Enum(pgreplay.TransactionsKeep, pgreplay.TransactionsFlatten, pgreplay.TransactionsSkipFailed)
+
+	analyze            = app.Command("analyze", "Report on the workload in a log before replaying it")
+	analyzeJsonInput   = analyze.Flag("json-input", "JSON input file").ExistingFile()
+	analyzeErrlogInput = analyze.Flag("errlog-input", "Postgres errlog input file").ExistingFile()
+	analyzeCsvLogInput = analyze.Flag("csvlog-input", "Postgres CSV log input file").ExistingFile()
+	analyzeFormat      = analyze.Flag("format", "Print the report as text or JSON").Default("text").Enum("text", "json")
+	analyzeTop         = analyze.Flag("top", "Number of query fingerprints to list").Default("20").Int()
+	analyzeInterval    = analyze.Flag("interval", "Width of each interval of the timeline").Default("1m").Duration()
+
+	index          = app.Command("index", "Build a seekable index for a pgreplay JSON log, allowing runs to --start part way through it without parsing everything before")
+	indexJsonInput = index.Flag("json-input", "JSON input file").Required().ExistingFile()
+	indexOutput    = index.Flag("output", "Index output file (defaults to the input path with an .idx suffix)").String()
+
+	indexAllowEncrypted = index.Flag("allow-encrypted-input", "Index an encrypted input, writing its session IDs and timestamps to the index in plaintext").Bool()
+
+	run                       = app.Command("run", "Replay from log files against a real database")
+	runHost                   = run.Flag("host", "PostgreSQL database host").Required().String()
+	runPort                   = run.Flag("port", "PostgreSQL database port").Default("5432").Uint16()
+	runDatname                = run.Flag("database", "PostgreSQL root database").Default("postgres").String()
+	runUser                   = run.Flag("user", "PostgreSQL root user").Default("postgres").String()
+	runPassword               = run.Flag("password", "PostgreSQl password user (the default value is obtained from the DB_PASSWORD env var)").Default(os.Getenv("DB_PASSWORD")).String()
+	runReplayRate             = run.Flag("replay-rate", "Rate of playback, will execute queries at Nx speed").Default("1").IsSetByUser(&runReplayRateSet).Float()
+	runTiming                 = run.Flag("timing", "Schedule items against the start of the replay (global), or preserve each session's think time between statements (session)").Default(pgreplay.TimingGlobal).Enum(pgreplay.TimingGlobal, pgreplay.TimingSession)
+	runStrictOrdering         = run.Flag("strict-ordering", "Only execute an item once every earlier item, in any session, has completed").Bool()
+	runOrderingTimeout        = run.Flag("strict-ordering-timeout", "Stop waiting on earlier items after this long, 0 to wait indefinitely").Default("10s").Duration()
+	runMaxSpeed               = run.Flag("max-speed", "Ignore timestamps and replay as fast as possible, preserving the order of each session").Bool()
+	runConnectRetries         = run.Flag("connect-retries", "Retry failed connection attempts this many times before dropping the session").Default("0").Int()
+	runConnectBackoff         = run.Flag("connect-backoff", "Wait before retrying a failed connection, doubling after each attempt").Default("100ms").Duration()
+	runConnectMaxBackoff      = run.Flag("connect-max-backoff", "Longest wait between connection attempts").Default("5s").Duration()
+	runConnectGiveUpAfter     = run.Flag("connect-give-up-after", "Drop a session once we've spent this long trying to connect it, 0 for no limit").Default("0").Duration()
+	runConnectTimeout         = run.Flag("connect-timeout", "Bound each connection attempt, 0 to wait indefinitely").Default("0").Duration()
+	runQueueSize              = run.Flag("queue-size", "Most items each session may have waiting to execute, 0 for no limit").Default("0").Int()
+	runQueueOverflow          = run.Flag("queue-overflow", "What to do when a session's queue is full").Default(pgreplay.QueueBlock).Enum(pgreplay.QueueBlock, pgreplay.QueueDropOldest, pgreplay.QueueDropNewest, pgreplay.QueueShed)
+	runQueueShedAfter         = run.Flag("queue-shed-after", "With --queue-overflow=shed, drop queued items that have waited longer than this").Default("30s").Duration()
+	runDisconnectOnSchedule   = run.Flag("disconnect-on-schedule", "Disconnect each session when it originally disconnected, skipping any statements it has yet to execute").Bool()
+	runMaxLag                 = run.Flag("max-lag", "Skip statements that are further than this behind schedule, 0 to never skip").Default("0").Duration()
+	runStatementTimeout       = run.Flag("statement-timeout", "Cancel any statement that runs for longer than this, 0 for no limit").Default("0").Duration()
+	runStatementTimeoutFactor = run.Flag("statement-timeout-factor", "Cancel statements that run for longer than this multiple of their logged duration, 0 to disable").Default("0").Float()
+	runStatementTimeoutFloor  = run.Flag("statement-timeout-floor", "Shortest timeout allowed by --statement-timeout-factor").Default("1s").Duration()
+	runTxRecovery             = run.Flag("tx-recovery", "Roll back sessions stuck in an aborted transaction (rollback), or leave them to fail (none)").Default(pgreplay.TxRecoveryNone).Enum(pgreplay.TxRecoveryNone, pgreplay.TxRecoveryRollback)
+	runTransactions           = run.Flag("transactions", "Keep transactions as logged (keep), roll back a transaction at its first error (abort), drop statements that control transactions (flatten), or drop transactions that failed originally (skip-failed)").Default(pgreplay.TransactionsKeep).Enum(pgreplay.TransactionsKeep, pgreplay.TransactionsAbort, pgreplay.TransactionsFlatten, pgreplay.TransactionsSkipFailed)
+	runItemFilter             = itemFilterFlags(run)
+	runSample                 = run.Flag("sample-sessions", "Keep this fraction of sessions, chosen by a hash of their ID").Default("1").Float()
+	runScale                  = run.Flag("scale", "Replay each session this many times, cloning it with a new session ID").Default("1").Int()
+	runScaleJitter            = run.Flag("scale-jitter", "Delay each cloned session by up to this long").Default("1s").Duration()
+	runTimeTransform          = timeTransformFlags(run)
+	runRules                  = run.Flag("rules", "YAML file of rules to rewrite or drop items, may be repeated").ExistingFiles()
+	runRulePresets            = run.Flag("rules-preset", "Apply a built-in set of rules ("+strings.Join(pgreplay.RulePresetNames(), ", ")+"), may be repeated").Enums(pgreplay.RulePresetNames()...)
+	runRateSchedule           = run.Flag("rate-schedule", "Vary the rate of playback over time, as OFFSET=RATE steps or OFFSET~RATE ramps (e.g. 0s=1,10m=2,20m=3)").String()
+	runRateScheduleFile       = run.Flag("rate-schedule-file", "Path to a file containing a rate schedule, one step per line").ExistingFile()
+	runRateScheduleClock      = run.Flag("rate-schedule-clock", "Measure rate schedule offsets in wall-clock time or log time").Default(pgreplay.RateScheduleWallClock).Enum(pgreplay.RateScheduleWallClock, pgreplay.RateScheduleLogClock)
+	runCheckpoint             = run.Flag("checkpoint", "Periodically save replay progress to this file").String()
+	runCheckpointInterval     = run.Flag("checkpoint-interval", "How often to save replay progress").Default("30s").Duration()
+	runResume                 = run.Flag("resume", "Resume a replay from a checkpoint file").ExistingFile()
+	runResumeSessions         = run.Flag("resume-sessions", "Reopen sessions that were active at the checkpoint, or skip their remaining items").Default(pgreplay.ResumeReopen).Enum(pgreplay.ResumeReopen, pgreplay.ResumeSkip)
+	runLoop                   = run.Flag("loop", "Replay the workload N times, or forever, for soak tests").Default("1").String()
+	runMaxDuration            = run.Flag("max-duration", "Stop the replay after this long, 0 for no limit").Default("0s").Duration()
+	runErrlogInput            = run.Flag("errlog-input", "Path to PostgreSQL errlog").ExistingFile()
+	runCsvLogInput            = run.Flag("csvlog-input", "Path to PostgreSQL CSV log").ExistingFile()
+	runJsonInput              = run.Flag("json-input", "Path to preprocessed pgreplay JSON log file").ExistingFile()
+
+	// Whether --replay-rate was given, as a rate schedule replaces its default
+	runReplayRateSet bool
 )
 
 func main() {
@@ -60,8 +133,9 @@ func main() {
 		logger = level.NewFilter(logger, level.AllowInfo())
 	}
 
-	// Starting the Prometheus Server
-	server := pgreplay.StartPrometheusServer(logger, *metricsAddress, *metricsPort)
+	// Starting the Prometheus Server, which also hosts the control API
+	controller := pgreplay.NewController()
+	server := pgreplay.StartPrometheusServer(logger, *metricsAddress, *metricsPort, controller)
 
 	var err error
 	var start, finish *time.Time
@@ -80,11 +154,11 @@ func main() {
 
 		switch checkSingleFormat(filterJsonInput, filterErrlogInput, filterCsvLogInput) {
 		case filterJsonInput:
-			items = parseLog(*filterJsonInput, pgreplay.ParseJSON)
+			items = parseLog(*filterJsonInput, 0, pgreplay.ParseJSON)
 		case filterErrlogInput:
-			items = parseLog(*filterErrlogInput, pgreplay.ParseErrlog)
+			items = parseLog(*filterErrlogInput, 0, pgreplay.ParseErrlog)
 		case filterCsvLogInput:
-			items = parseLog(*filterCsvLogInput, pgreplay.ParseCsvLog)
+			items = parseLog(*filterCsvLogInput, 0, pgreplay.ParseCsvLog)
 		default:
 			logger.Log("event", "postgres.error", "error", "you must provide an input")
 			os.Exit(255)
@@ -92,6 +166,12 @@ func main() {
 
 		// Apply the start and end filters
 		items = pgreplay.NewStreamer(start, finish, logger).Filter(items)
+		items = filterItems(items, filterItemFilter)
+		items = sampleSessions(items, *filterSample, *filterScale, *filterScaleJitter)
+		items = transformTimes(items, filterTimeTransform)
+		items = applyRules(items, *filterRules, *filterRulePresets)
+		items = replayTransactions(items, *filterTransactions)
+		items = anonymiseItems(items)
 
 		if *filterNullOutput {
 			logger.Log("event", "filter.null_output", "msg", "Null output enabled, logs won't be serialized")
@@ -99,6 +179,7 @@ func main() {
 				// no-op
 			}
 
+			logItemsExcluded(logger, filterItemFilter)
 			return
 		}
 
@@ -111,8 +192,22 @@ func main() {
 			kingpin.Fatalf("failed to create output file: %v", err)
 		}
 
+		var output io.Writer = outputFile
+		var encryptor *pgreplay.EncryptWriter
+		if *filterEncryptOutput {
+			if encryptor, err = pgreplay.NewEncryptWriter(outputFile, encryptionKey()); err != nil {
+				kingpin.Fatalf("failed to encrypt output file: %v", err)
+			}
+
+			output = encryptor
+		}
+
 		// Buffer the writes by 32MB to enable much faster filtering
-		buffer := bufio.NewWriterSize(outputFile, 32*1000*1000)
+		buffer := bufio.NewWriterSize(output, 32*1000*1000)
+
+		// Index the output as we write it, so runs can seek straight to their start
+		var offset int64
+		indexBuilder := pgreplay.NewIndexBuilder()
 
 		for item := range items {
 			bytes, err := pgreplay.ItemMarshalJSON(item)
@@ -120,16 +215,114 @@ func main() {
 				kingpin.Fatalf("failed to serialize item: %v", err)
 			}
 
+			if bytes == nil {
+				continue
+			}
+
 			if _, err := buffer.Write(append(bytes, byte('\n'))); err != nil {
 				kingpin.Fatalf("failed to write to output file: %v", err)
 			}
+
+			indexBuilder.Add(item, offset)
+			offset += int64(len(bytes) + 1)
+		}
+
+		if err := buffer.Flush(); err != nil {
+			kingpin.Fatalf("failed to write to output file: %v", err)
+		}
+
+		if encryptor != nil {
+			if err := encryptor.Close(); err != nil {
+				kingpin.Fatalf("failed to write to output file: %v", err)
+			}
+		}
+
+		if err := outputFile.Close(); err != nil {
+			kingpin.Fatalf("failed to write to output file: %v", err)
+		}
+
+		// An index would reveal the sessions of an encrypted output, so we don't write one
+		if encryptor != nil {
+			logger.Log("event", "index.skipped", "msg", "encrypted outputs are not indexed")
+		} else if err := indexBuilder.Index(offset).Save(pgreplay.IndexPath(*filterOutput)); err != nil {
+			kingpin.Fatalf("failed to write index: %v", err)
+		}
+
+		logItemsExcluded(logger, filterItemFilter)
+
+	case analyze.FullCommand():
+		var items chan pgreplay.Item
+
+		switch checkSingleFormat(analyzeJsonInput, analyzeErrlogInput, analyzeCsvLogInput) {
+		case analyzeJsonInput:
+			items = parseLog(*analyzeJsonInput, 0, pgreplay.ParseJSON)
+		case analyzeErrlogInput:
+			items = parseLog(*analyzeErrlogInput, 0, pgreplay.ParseErrlog)
+		case analyzeCsvLogInput:
+			items = parseLog(*analyzeCsvLogInput, 0, pgreplay.ParseCsvLog)
+		}
+
+		if *analyzeInterval <= 0 {
+			kingpin.Fatalf("--interval must be positive")
+		}
+
+		if *analyzeTop < 0 {
+			kingpin.Fatalf("--top must not be negative")
+		}
+
+		analyzer := pgreplay.NewAnalyzer(*analyzeInterval)
+		for item := range pgreplay.NewStreamer(start, finish, logger).Filter(items) {
+			analyzer.Add(item)
+		}
+
+		analysis := analyzer.Analysis(*analyzeTop)
+		if *analyzeFormat == "json" {
+			if err := json.NewEncoder(os.Stdout).Encode(analysis); err != nil {
+				kingpin.Fatalf("failed to write analysis: %v", err)
+			}
+		} else if err := analysis.WriteText(os.Stdout); err != nil {
+			kingpin.Fatalf("failed to write analysis: %v", err)
+		}
+
+	case index.FullCommand():
+		// Like filter, we won't reveal the sessions of an encrypted log unless asked to
+		if isEncryptedFile(*indexJsonInput) && !*indexAllowEncrypted {
+			kingpin.Fatalf("refusing to write a plaintext index for an encrypted input, pass --allow-encrypted-input to index it anyway")
 		}
 
-		buffer.Flush()
-		outputFile.Close()
+		items := parseLog(*indexJsonInput, 0, pgreplay.ParseJSON)
+		indexBuilder := pgreplay.NewIndexBuilder()
+		for item := range items {
+			indexBuilder.Add(item, pgreplay.SourceOffset(item))
+		}
+
+		stat, err := os.Stat(*indexJsonInput)
+		if err != nil {
+			kingpin.Fatalf("failed to stat input: %v", err)
+		}
+
+		if *indexOutput == "" {
+			*indexOutput = pgreplay.IndexPath(*indexJsonInput)
+		}
+
+		built := indexBuilder.Index(stat.Size())
+		if err := built.Save(*indexOutput); err != nil {
+			kingpin.Fatalf("failed to write index: %v", err)
+		}
+
+		logger.Log("event", "index.finished", "output", *indexOutput, "entries", len(built.Entries), "sessions", len(built.Sessions))
 
 	case run.FullCommand():
-		ctx := context.Background()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go handleSignals(cancel)
+		go func() {
+			<-controller.Stopped()
+			logger.Log("event", "shutdown.requested", "msg", "stop requested through control API")
+			cancel()
+		}()
+
 		database, err := pgreplay.NewDatabase(
 			ctx,
 			pgreplay.DatabaseConnConfig{
@@ -146,22 +339,186 @@ func main() {
 			os.Exit(255)
 		}
 
+		var checkpoint *pgreplay.Checkpoint
+		if *runResume != "" {
+			if checkpoint, err = pgreplay.LoadCheckpoint(*runResume); err != nil {
+				kingpin.Fatalf("failed to load checkpoint: %s", err)
+			}
+
+			logger.Log("event", "checkpoint.resume", "timestamp", checkpoint.Timestamp, "sessions", len(checkpoint.Sessions))
+		}
+
+		// If we're starting part way through an indexed JSON log then we can seek straight
+		// to our start, reopening the sessions that were active at that point. Resuming
+		// from the seek applies our start, and stamps the reopening Connects at it, so we
+		// mustn't filter on the start again.
+		reopen := *runResumeSessions == pgreplay.ResumeReopen
+		filterStart := start
+		if checkpoint == nil && start != nil && *runJsonInput != "" {
+			if checkpoint = loadIndexCheckpoint(*runJsonInput, *start); checkpoint != nil {
+				reopen, filterStart = true, nil
+			}
+		}
+
+		format := checkSingleFormat(runJsonInput, runErrlogInput, runCsvLogInput)
+
+		// openItems parses our input from the beginning, or from wherever our checkpoint
+		// says we should begin
+		openItems := func() chan pgreplay.Item {
+			var items chan pgreplay.Item
+
+			switch format {
+			case runJsonInput:
+				var offset int64
+				if checkpoint != nil {
+					offset = checkpoint.Offset
+				}
+
+				items = parseLog(*runJsonInput, offset, pgreplay.ParseJSON)
+			case runErrlogInput:
+				items = parseLog(*runErrlogInput, 0, pgreplay.ParseErrlog)
+			case runCsvLogInput:
+				items = parseLog(*runCsvLogInput, 0, pgreplay.ParseCsvLog)
+			default:
+				logger.Log("event", "postgres.error", "error", "you must provide an input")
+				os.Exit(255)
+			}
+
+			if checkpoint != nil {
+				items = checkpoint.Resume(items, reopen)
+			}
+
+			// Filter before looping, so that sessions match by their logged IDs
+			items = filterItems(items, runItemFilter)
+
+			return sampleSessions(items, *runSample, *runScale, *runScaleJitter)
+		}
+
+		loopIterations, err := pgreplay.ParseLoopIterations(*runLoop)
+		if err != nil {
+			kingpin.Fatalf("--loop flag %s", err)
+		}
+
+		if loopIterations != 1 && (*runResume != "" || *runCheckpoint != "") {
+			kingpin.Fatalf("cannot checkpoint or resume a replay with --loop")
+		}
+
+		// Checkpoints record the sessions of the scaled workload, which we'd clone again
+		if *runScale != 1 && (*runResume != "" || *runCheckpoint != "") {
+			kingpin.Fatalf("cannot checkpoint or resume a replay with --scale")
+		}
+
+		// Checkpoints record transformed timestamps, which wouldn't match the log we resume
+		if !runTimeTransform.Empty() && (*runResume != "" || *runCheckpoint != "") {
+			kingpin.Fatalf("cannot checkpoint or resume a replay that collapses, shifts or jitters time")
+		}
+
+		// When looping, each iteration must apply the start and finish filters before its
+		// timestamps are shifted, so the streamer should not filter again
 		var items chan pgreplay.Item
+		streamerStart, streamerFinish := filterStart, finish
+		if loopIterations != 1 {
+			items = pgreplay.Loop(ctx, func() chan pgreplay.Item {
+				return pgreplay.NewStreamer(filterStart, finish, logger).Filter(openItems())
+			}, loopIterations)
+
+			streamerStart, streamerFinish = nil, nil
+		} else {
+			items = openItems()
+		}
 
-		switch checkSingleFormat(runJsonInput, runErrlogInput, runCsvLogInput) {
-		case runJsonInput:
-			items = parseLog(*runJsonInput, pgreplay.ParseJSON)
-		case runErrlogInput:
-			items = parseLog(*runErrlogInput, pgreplay.ParseErrlog)
-		case runCsvLogInput:
-			items = parseLog(*runCsvLogInput, pgreplay.ParseCsvLog)
-		default:
-			logger.Log("event", "postgres.error", "error", "you must provide an input")
-			os.Exit(255)
+		// The start and finish are logged times, so we must apply them before transforming
+		// timestamps, if the loop hasn't already
+		if !runTimeTransform.Empty() {
+			if loopIterations == 1 {
+				items = pgreplay.NewStreamer(filterStart, finish, logger).Filter(items)
+			}
+
+			streamerStart, streamerFinish = nil, nil
+		}
+
+		items = transformTimes(items, runTimeTransform)
+		items = applyRules(items, *runRules, *runRulePresets)
+		items = replayTransactions(items, *runTransactions)
+
+		if *runMaxDuration > 0 {
+			time.AfterFunc(*runMaxDuration, func() {
+				logger.Log("event", "shutdown.requested", "msg", "reached --max-duration", "duration", *runMaxDuration)
+				cancel()
+			})
+		}
+
+		summary := pgreplay.NewSummary()
+		observers := pgreplay.MultiObserver{summary}
+
+		if *runCheckpoint != "" {
+			checkpointer := pgreplay.NewCheckpointer(*runCheckpoint, *runCheckpointInterval, logger)
+			if checkpoint != nil && reopen {
+				checkpointer.Seed(*checkpoint)
+			}
+
+			observers = append(observers, checkpointer)
+		}
+
+		database.Observer = observers
+		database.Timing = *runTiming
+		database.Controller = controller
+		database.StrictOrdering = *runStrictOrdering
+		database.OrderingTimeout = *runOrderingTimeout
+		database.ConnectRetries = *runConnectRetries
+		database.ConnectBackoff = *runConnectBackoff
+		database.ConnectMaxBackoff = *runConnectMaxBackoff
+		database.ConnectGiveUpAfter = *runConnectGiveUpAfter
+		database.ConnectTimeout = *runConnectTimeout
+		database.Queue = pgreplay.QueuePolicy{
+			Capacity:  *runQueueSize,
+			Overflow:  *runQueueOverflow,
+			ShedAfter: *runQueueShedAfter,
+		}
+		if err := database.Queue.Validate(); err != nil {
+			kingpin.Fatalf("invalid queue policy: %s", err)
+		}
+
+		database.StatementTimeout = pgreplay.StatementTimeout{
+			Absolute: *runStatementTimeout,
+			Factor:   *runStatementTimeoutFactor,
+			Floor:    *runStatementTimeoutFloor,
+		}
+		if *runStatementTimeout < 0 || *runStatementTimeoutFactor < 0 {
+			kingpin.Fatalf("statement timeouts must not be negative")
+		}
+
+		database.TxRecovery = *runTxRecovery
+		database.AbortTransactions = *runTransactions == pgreplay.TransactionsAbort
+		database.DisconnectOnSchedule = *runDisconnectOnSchedule
+		if database.DisconnectOnSchedule && database.Timing == pgreplay.TimingSession {
+			kingpin.Fatalf("cannot use --disconnect-on-schedule with --timing session, which runs sessions behind schedule by design")
+		}
+
+		database.MaxLag = *runMaxLag
+		if database.MaxLag > 0 && database.Timing == pgreplay.TimingSession {
+			kingpin.Fatalf("cannot use --max-lag with --timing session, which runs sessions behind schedule by design")
+		}
+
+		streamer := pgreplay.NewStreamer(streamerStart, streamerFinish, logger)
+		streamer.Observer = summary
+		streamer.Controller = controller
+		streamer.RateSchedule = parseRateSchedule(*runRateSchedule, *runRateScheduleFile, *runRateScheduleClock)
+		streamer.MaxSpeed = *runMaxSpeed
+		if streamer.MaxSpeed && streamer.RateSchedule != nil {
+			kingpin.Fatalf("cannot use a rate schedule with --max-speed")
+		}
+
+		if runReplayRateSet && streamer.RateSchedule != nil {
+			kingpin.Fatalf("cannot use --replay-rate with a rate schedule, which sets the rate itself")
+		}
+
+		if streamer.MaxSpeed && database.Timing == pgreplay.TimingSession {
+			kingpin.Fatalf("cannot preserve session think time with --max-speed")
 		}
 
 		replay_started := time.Now()
-		stream, err := pgreplay.NewStreamer(start, finish, logger).Stream(items, *runReplayRate)
+		stream, err := streamer.Stream(ctx, items, *runReplayRate)
 		if err != nil {
 			kingpin.Fatalf("failed to start streamer: %s", err)
 		}
@@ -181,10 +538,28 @@ func main() {
 					status = 255
 				}
 
-				logger.Log("event", "consume.finished", "error", err, "status", status)
+				logger.Log("event", "consume.finished", "error", err, "status", status, "interrupted", ctx.Err() != nil)
 				logger.Log("event", "time.elapsed", "total", buildTimeElapsed(replay_started))
+				summary.Log(logger)
+				if database.StrictOrdering {
+					stall, timeouts := database.OrderingStall()
+					logger.Log("event", "ordering.stall", "total", stall.String(), "timeouts", timeouts)
+				}
+				logItemsExcluded(logger, runItemFilter)
+				if database.MaxLag > 0 {
+					logLagSkips(logger, database.LagSkips())
+				}
+				if tx := database.TxRecoveryReport(); tx.Aborted > 0 || tx.Rollbacks > 0 {
+					logger.Log(
+						"event", "tx.recovery",
+						"aborted_statements", tx.Aborted,
+						"rollbacks", tx.Rollbacks,
+						"statements_saved", tx.Saved,
+						"statements_lost", tx.Lost,
+					)
+				}
 				logger.Log("event", "server.status", "message", "shutting down the server!")
-				err = pgreplay.ShutdownServer(ctx, server)
+				err = pgreplay.ShutdownServer(context.Background(), server, *metricsWait)
 				if err != nil {
 					logger.Log("error", "server.shutdown", "message", err.Error())
 				}
@@ -195,6 +570,192 @@ func main() {
 	}
 }
 
+// itemFilterFlags adds the repeatable flags that select items by user, database,
+// application or session to the command
+func itemFilterFlags(cmd *kingpin.CmdClause) *pgreplay.ItemFilter {
+	itemFilter := &pgreplay.ItemFilter{}
+	cmd.Flag("include-user", "Only keep items from users matching this glob, may be repeated").StringsVar(&itemFilter.IncludeUsers)
+	cmd.Flag("exclude-user", "Remove items from users matching this glob, may be repeated").StringsVar(&itemFilter.ExcludeUsers)
+	cmd.Flag("include-database", "Only keep items for databases matching this glob, may be repeated").StringsVar(&itemFilter.IncludeDatabases)
+	cmd.Flag("exclude-database", "Remove items for databases matching this glob, may be repeated").StringsVar(&itemFilter.ExcludeDatabases)
+	cmd.Flag("include-application", "Only keep items from applications matching this glob, which requires csvlog input, may be repeated").StringsVar(&itemFilter.IncludeApplications)
+	cmd.Flag("session", "Only keep items from sessions matching this glob, may be repeated").StringsVar(&itemFilter.Sessions)
+
+	return itemFilter
+}
+
+// filterItems removes the items excluded by the user, database, application and session
+// flags
+func filterItems(items chan pgreplay.Item, filter *pgreplay.ItemFilter) chan pgreplay.Item {
+	if err := filter.Validate(); err != nil {
+		kingpin.Fatalf("invalid filter: %s", err)
+	}
+
+	if filter.Empty() {
+		return items
+	}
+
+	return filter.Apply(items)
+}
+
+// sampleSessions keeps a fraction of sessions, then clones each of them to scale the
+// workload
+func sampleSessions(items chan pgreplay.Item, fraction float64, factor int, jitter time.Duration) chan pgreplay.Item {
+	if err := pgreplay.ValidateSampling(fraction, factor, jitter); err != nil {
+		kingpin.Fatalf("invalid sampling: %s", err)
+	}
+
+	if fraction < 1 {
+		items = pgreplay.SampleSessions(items, fraction)
+	}
+
+	if factor > 1 {
+		items = pgreplay.ScaleSessions(items, factor, jitter)
+	}
+
+	return items
+}
+
+// timeTransformFlags adds the flags that collapse idle periods, shift and jitter the
+// workload's timestamps to the command
+func timeTransformFlags(cmd *kingpin.CmdClause) *pgreplay.TimeTransform {
+	transform := &pgreplay.TimeTransform{}
+	cmd.Flag("collapse-idle-over", "Collapse periods where no session logs anything for longer than this, 0 to never collapse").Default("0").DurationVar(&transform.CollapseIdleOver)
+	cmd.Flag("collapse-idle-to", "Shorten each collapsed idle period to this long").Default("1s").DurationVar(&transform.CollapseIdleTo)
+	cmd.Flag("time-shift", "Move every item by this long, which may be negative (e.g. --time-shift=-24h)").Default("0").DurationVar(&transform.Shift)
+	cmd.Flag("time-jitter", "Move each item by a random amount of up to this long either way, keeping each session's order").Default("0").DurationVar(&transform.Jitter)
+
+	return transform
+}
+
+// transformTimes collapses idle periods, then shifts and jitters timestamps, when asked to
+func transformTimes(items chan pgreplay.Item, transform *pgreplay.TimeTransform) chan pgreplay.Item {
+	if err := transform.Validate(); err != nil {
+		kingpin.Fatalf("invalid time transform: %s", err)
+	}
+
+	if transform.Empty() {
+		return items
+	}
+
+	return transform.Apply(items)
+}
+
+// logItemsExcluded reports how many items each filter removed, if any were in use
+func logItemsExcluded(logger kitlog.Logger, filter *pgreplay.ItemFilter) {
+	if filter.Empty() {
+		return
+	}
+
+	removed := filter.Removed()
+	logger.Log(
+		"event", "filter.excluded",
+		"include_user", removed[pgreplay.FilterIncludeUser],
+		"exclude_user", removed[pgreplay.FilterExcludeUser],
+		"include_database", removed[pgreplay.FilterIncludeDatabase],
+		"exclude_database", removed[pgreplay.FilterExcludeDatabase],
+		"include_application", removed[pgreplay.FilterIncludeApplication],
+		"session", removed[pgreplay.FilterSession],
+	)
+}
+
+// anonymiseKeyEnv may hold the key for --anonymise, as an alternative to a key file
+const anonymiseKeyEnv = "PGREPLAY_ANONYMISE_KEY"
+
+// anonymiseItems pseudonymises values when asked to, and always redacts passwords
+func anonymiseItems(items chan pgreplay.Item) chan pgreplay.Item {
+	var key []byte
+	if *filterAnonymise {
+		encoded := os.Getenv(anonymiseKeyEnv)
+		if *filterAnonymiseKeyFile != "" {
+			payload, err := os.ReadFile(*filterAnonymiseKeyFile)
+			if err != nil {
+				kingpin.Fatalf("failed to read anonymise key: %s", err)
+			}
+
+			encoded = string(payload)
+		}
+
+		if encoded == "" {
+			kingpin.Fatalf("--anonymise requires --anonymise-key-file or %s", anonymiseKeyEnv)
+		}
+
+		var err error
+		if key, err = pgreplay.ParseAnonymiseKey(encoded); err != nil {
+			kingpin.Fatalf("invalid anonymise key: %s", err)
+		}
+	} else if len(*filterAnonymiseAllowColumns)+len(*filterAnonymiseAllowValues) > 0 {
+		kingpin.Fatalf("anonymise allowlists require --anonymise")
+	}
+
+	anonymiser := pgreplay.NewAnonymiser(key)
+	anonymiser.AllowColumns = *filterAnonymiseAllowColumns
+	for _, pattern := range *filterAnonymiseAllowValues {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			kingpin.Fatalf("invalid --anonymise-allow-value: %s", err)
+		}
+
+		anonymiser.AllowValues = append(anonymiser.AllowValues, compiled)
+	}
+
+	return anonymiser.Apply(items)
+}
+
+// applyRules loads the rules from each file and preset, in that order, and applies them
+// to the items
+func applyRules(items chan pgreplay.Item, files, presets []string) chan pgreplay.Item {
+	var rules pgreplay.Rules
+	for _, file := range files {
+		loaded, err := pgreplay.LoadRules(file)
+		if err != nil {
+			kingpin.Fatalf("failed to load rules from %s: %s", file, err)
+		}
+
+		rules = append(rules, loaded...)
+	}
+
+	for _, preset := range presets {
+		rules = append(rules, pgreplay.RulePresets[preset]...)
+	}
+
+	if len(rules) == 0 {
+		return items
+	}
+
+	return pgreplay.ApplyRules(items, rules)
+}
+
+// replayTransactions prepares items for the chosen handling of transactions
+func replayTransactions(items chan pgreplay.Item, mode string) chan pgreplay.Item {
+	switch mode {
+	case pgreplay.TransactionsAbort:
+		return pgreplay.GroupTransactions(items)
+	case pgreplay.TransactionsFlatten:
+		return pgreplay.FlattenTransactions(items)
+	case pgreplay.TransactionsSkipFailed:
+		return pgreplay.SkipFailedTransactions(pgreplay.GroupTransactions(items))
+	default:
+		return items
+	}
+}
+
+// logLagSkips summarises the items we skipped for being too far behind schedule, along
+// with the sessions that skipped the most
+func logLagSkips(logger kitlog.Logger, report pgreplay.LagReport) {
+	logger.Log(
+		"event", "lag.skipped",
+		"total", report.Total,
+		"statements", report.ByType[pgreplay.StatementLabel],
+		"bound_executes", report.ByType[pgreplay.BoundExecuteLabel],
+		"sessions", report.Sessions,
+	)
+
+	for _, sessionID := range report.TopSessions(10) {
+		logger.Log("event", "lag.skipped.session", "session_id", sessionID, "total", report.BySession[sessionID])
+	}
+}
+
 // Set by goreleaser
 var (
 	Version   = "dev"
@@ -210,6 +771,22 @@ func versionStanza() string {
 	)
 }
 
+// handleSignals cancels the replay on the first SIGINT or SIGTERM, allowing in-flight
+// statements to be cancelled and connections closed cleanly. A second signal forces us to
+// exit immediately.
+func handleSignals(cancel func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	logger.Log("event", "shutdown.requested", "signal", sig, "msg", "stopping replay, signal again to force exit")
+	cancel()
+
+	sig = <-signals
+	logger.Log("event", "shutdown.forced", "signal", sig)
+	os.Exit(255)
+}
+
 func checkSingleFormat(formats ...*string) (result *string) {
 	var supplied = 0
 	for _, format := range formats {
@@ -226,16 +803,116 @@ func checkSingleFormat(formats ...*string) (result *string) {
 	return result // which becomes the one that isn't empty
 }
 
-func parseLog(path string, parser pgreplay.ParserFunc) chan pgreplay.Item {
+// loadIndexCheckpoint finds where to begin reading an indexed JSON log in order to start
+// at the given time, returning nil if the log has no usable index.
+func loadIndexCheckpoint(path string, start time.Time) *pgreplay.Checkpoint {
+	index, err := pgreplay.LoadIndex(pgreplay.IndexPath(path))
+	if err != nil {
+		level.Debug(logger).Log("event", "index.unavailable", "error", err)
+		return nil
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		kingpin.Fatalf("failed to stat input: %v", err)
+	}
+
+	if stat.Size() != index.Size {
+		logger.Log("event", "index.stale", "msg", "index does not match input, ignoring it", "path", pgreplay.IndexPath(path))
+		return nil
+	}
+
+	checkpoint := index.Checkpoint(start)
+	logger.Log("event", "index.seek", "offset", checkpoint.Offset, "sessions", len(checkpoint.Sessions))
+
+	return &checkpoint
+}
+
+// encryptionKeyEnv may hold the key for encrypted JSON logs, as an alternative to a key
+// file
+const encryptionKeyEnv = "PGREPLAY_ENCRYPTION_KEY"
+
+// encryptionKey loads the key for encrypted JSON logs, failing if there isn't one
+func encryptionKey() []byte {
+	encoded := os.Getenv(encryptionKeyEnv)
+	if *encryptionKeyFile != "" {
+		payload, err := os.ReadFile(*encryptionKeyFile)
+		if err != nil {
+			kingpin.Fatalf("failed to read encryption key: %s", err)
+		}
+
+		encoded = string(payload)
+	}
+
+	if encoded == "" {
+		kingpin.Fatalf("encrypted logs require --encryption-key-file or %s", encryptionKeyEnv)
+	}
+
+	key, err := pgreplay.ParseEncryptionKey(encoded)
+	if err != nil {
+		kingpin.Fatalf("invalid encryption key: %s", err)
+	}
+
+	return key
+}
+
+// isEncryptedFile is true when the file at path was written with --encrypt-output
+func isEncryptedFile(path string) bool {
 	file, err := os.Open(path)
 	if err != nil {
 		kingpin.Fatalf("failed to open logfile: %s", err)
 	}
 
-	items, logerrs, done := parser(file)
+	defer file.Close()
+
+	header := make([]byte, len(pgreplay.EncryptionMagic))
+	n, _ := io.ReadFull(file, header)
+
+	return pgreplay.IsEncrypted(header[:n])
+}
+
+// parseLog opens the log file, seeking to the given offset, and parses it into items
+func parseLog(path string, offset int64, parser pgreplay.ParserFunc) chan pgreplay.Item {
+	file, err := os.Open(path)
+	if err != nil {
+		kingpin.Fatalf("failed to open logfile: %s", err)
+	}
+
+	// Encrypted logs are decrypted as we read them, which only allows seeking forward
+	var input io.ReadSeeker = file
+	header := make([]byte, len(pgreplay.EncryptionMagic))
+	if n, _ := io.ReadFull(file, header); pgreplay.IsEncrypted(header[:n]) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			kingpin.Fatalf("failed to seek logfile: %s", err)
+		}
+
+		if input, err = pgreplay.NewDecryptReader(file, encryptionKey()); err != nil {
+			kingpin.Fatalf("failed to decrypt %s: %s", path, err)
+		}
+	}
+
+	if _, err := input.Seek(offset, io.SeekStart); err != nil {
+		kingpin.Fatalf("failed to seek logfile: %s", err)
+	}
+
+	items, logerrs, done := parser(input)
+
+	// We don't close our items until we know how parsing finished, so that a truncated
+	// or tampered encrypted log fails the command before anything can consider it done
+	out := make(chan pgreplay.Item, pgreplay.ItemBufferSize)
 
 	go func() {
-		logger.Log("event", "parse.finished", "error", <-done)
+		for item := range items {
+			out <- item
+		}
+
+		err := <-done
+		if errors.Is(err, pgreplay.ErrEncryptedCorrupt) {
+			kingpin.Fatalf("failed to decrypt %s: %s", path, err)
+		}
+
+		logger.Log("event", "parse.finished", "error", err)
+		close(out)
 	}()
 
 	go func() {
@@ -244,7 +921,35 @@ func parseLog(path string, parser pgreplay.ParserFunc) chan pgreplay.Item {
 		}
 	}()
 
-	return items
+	return out
+}
+
+// parseRateSchedule loads a rate schedule from either the inline flag or a file, returning
+// nil if neither were provided.
+func parseRateSchedule(inline, path, clock string) *pgreplay.RateSchedule {
+	if inline != "" && path != "" {
+		kingpin.Fatalf("must provide only one of --rate-schedule or --rate-schedule-file")
+	}
+
+	if path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			kingpin.Fatalf("failed to read rate schedule: %s", err)
+		}
+
+		inline = string(contents)
+	}
+
+	if inline == "" {
+		return nil
+	}
+
+	schedule, err := pgreplay.ParseRateSchedule(inline, clock)
+	if err != nil {
+		kingpin.Fatalf("invalid rate schedule: %s", err)
+	}
+
+	return schedule
 }
 
 // parseTimestamp parsed a Postgres friendly timestamp
@@ -0,0 +1,433 @@
+package pgreplay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Analyzer builds a report describing a workload, from each of its items in turn, so
+// that we can understand a capture before replaying it
+type Analyzer struct {
+	interval time.Duration
+
+	items        int
+	first, last  time.Time
+	types        map[string]int
+	commands     map[string]int
+	fingerprints map[string]*FingerprintStats
+	users        map[string]*Breakdown
+	databases    map[string]*Breakdown
+
+	// timeline has a bucket per interval since the first item
+	timeline []AnalysisBucket
+	// open maps each session we've seen, but not yet seen disconnect, to its first and
+	// most recent timestamps
+	open    map[SessionID][2]time.Time
+	lengths []time.Duration
+}
+
+// Analysis is the report produced by an Analyzer
+type Analysis struct {
+	Items    int           `json:"items"`
+	Start    time.Time     `json:"start"`
+	Finish   time.Time     `json:"finish"`
+	Interval time.Duration `json:"interval"`
+	// Types counts items by their type, as in Statement or BoundExecute
+	Types map[string]int `json:"types"`
+	// Commands counts queries by their leading keyword, as in SELECT or INSERT
+	Commands      map[string]int     `json:"commands"`
+	TopByCount    []FingerprintStats `json:"top_by_count"`
+	TopByDuration []FingerprintStats `json:"top_by_duration"`
+	Timeline      []AnalysisBucket   `json:"timeline"`
+	Sessions      SessionLengths     `json:"sessions"`
+	Users         []Breakdown        `json:"users"`
+	Databases     []Breakdown        `json:"databases"`
+}
+
+// FingerprintStats describes the executions of queries sharing a fingerprint. Duration
+// only includes executions that were logged with their duration.
+type FingerprintStats struct {
+	Fingerprint string        `json:"fingerprint"`
+	Count       int           `json:"count"`
+	Timed       int           `json:"timed"`
+	Duration    time.Duration `json:"duration"`
+}
+
+// Mean is the average logged duration of executions that were logged with one
+func (s FingerprintStats) Mean() time.Duration {
+	if s.Timed == 0 {
+		return 0
+	}
+
+	return s.Duration / time.Duration(s.Timed)
+}
+
+// AnalysisBucket describes an interval of the workload. Sessions is the most sessions
+// that were connected at once during the interval.
+type AnalysisBucket struct {
+	Start          time.Time `json:"start"`
+	Items          int       `json:"items"`
+	ItemsPerSecond float64   `json:"items_per_second"`
+	Sessions       int       `json:"sessions"`
+}
+
+// SessionLengths describes how long sessions lasted. Unfinished sessions never
+// disconnected, and are measured until their last item.
+type SessionLengths struct {
+	Total      int            `json:"total"`
+	Unfinished int            `json:"unfinished"`
+	P50        time.Duration  `json:"p50"`
+	P90        time.Duration  `json:"p90"`
+	P99        time.Duration  `json:"p99"`
+	Max        time.Duration  `json:"max"`
+	Histogram  []LengthBucket `json:"histogram"`
+}
+
+// LengthBucket counts the sessions that lasted less than Under, and at least as long as
+// the previous bucket. The last bucket has no upper limit, and a zero Under.
+type LengthBucket struct {
+	Under time.Duration `json:"under"`
+	Count int           `json:"count"`
+}
+
+var sessionLengthBuckets = []time.Duration{
+	time.Second, 10 * time.Second, time.Minute, 10 * time.Minute, time.Hour,
+}
+
+// Breakdown summarises the items of a single user or database
+type Breakdown struct {
+	Name     string        `json:"name"`
+	Items    int           `json:"items"`
+	Queries  int           `json:"queries"`
+	Sessions int           `json:"sessions"`
+	Duration time.Duration `json:"duration"`
+}
+
+func NewAnalyzer(interval time.Duration) *Analyzer {
+	return &Analyzer{
+		interval:     interval,
+		types:        map[string]int{},
+		commands:     map[string]int{},
+		fingerprints: map[string]*FingerprintStats{},
+		users:        map[string]*Breakdown{},
+		databases:    map[string]*Breakdown{},
+		open:         map[SessionID][2]time.Time{},
+	}
+}
+
+// Add includes the item in the analysis. Items are expected in the order they were
+// logged.
+func (a *Analyzer) Add(item Item) {
+	if item == nil {
+		return
+	}
+
+	ts := item.GetTimestamp()
+	if a.items == 0 {
+		a.first = ts
+	}
+
+	if ts.After(a.last) {
+		a.last = ts
+	}
+
+	a.items++
+	a.types[ItemLabel(item)]++
+
+	user := breakdownFor(a.users, item.GetUser())
+	database := breakdownFor(a.databases, item.GetDatabase())
+	user.Items++
+	database.Items++
+
+	if fingerprint, ok := FingerprintOf(item); ok {
+		stats, ok := a.fingerprints[fingerprint]
+		if !ok {
+			stats = &FingerprintStats{Fingerprint: fingerprint}
+			a.fingerprints[fingerprint] = stats
+		}
+
+		duration := itemDuration(item)
+		stats.Count++
+		if duration > 0 {
+			stats.Timed++
+			stats.Duration += duration
+		}
+
+		a.commands[commandOf(fingerprint)]++
+		user.Queries++
+		user.Duration += duration
+		database.Queries++
+		database.Duration += duration
+	}
+
+	// Buckets we skip over had the same sessions connected as the last, so we must find
+	// our bucket before opening any new session
+	bucket := a.bucketFor(ts)
+	bucket.Items++
+
+	// Track sessions, so that we can measure how many are connected in each interval
+	sessionID := item.GetSessionID()
+	session, ok := a.open[sessionID]
+	if !ok {
+		session[0] = ts
+		user.Sessions++
+		database.Sessions++
+	}
+
+	session[1] = ts
+	a.open[sessionID] = session
+
+	if len(a.open) > bucket.Sessions {
+		bucket.Sessions = len(a.open)
+	}
+
+	switch item.(type) {
+	case Disconnect, *Disconnect:
+		a.lengths = append(a.lengths, session[1].Sub(session[0]))
+		delete(a.open, sessionID)
+	}
+}
+
+// bucketFor returns the timeline bucket for the timestamp, adding any buckets between it
+// and the last. Sessions remain connected across buckets.
+func (a *Analyzer) bucketFor(ts time.Time) *AnalysisBucket {
+	idx := 0
+	if a.interval > 0 && ts.After(a.first) {
+		idx = int(ts.Sub(a.first) / a.interval)
+	}
+
+	for len(a.timeline) <= idx {
+		a.timeline = append(a.timeline, AnalysisBucket{
+			Start:    a.first.Add(time.Duration(len(a.timeline)) * a.interval),
+			Sessions: len(a.open),
+		})
+	}
+
+	return &a.timeline[idx]
+}
+
+func breakdownFor(breakdowns map[string]*Breakdown, name string) *Breakdown {
+	breakdown, ok := breakdowns[name]
+	if !ok {
+		breakdown = &Breakdown{Name: name}
+		breakdowns[name] = breakdown
+	}
+
+	return breakdown
+}
+
+// commandOf is the leading keyword of a fingerprint, as in SELECT
+func commandOf(fingerprint string) string {
+	fields := strings.FieldsFunc(fingerprint, func(r rune) bool {
+		return !(r == '_' || (r >= 'a' && r <= 'z'))
+	})
+
+	if len(fields) == 0 {
+		return "OTHER"
+	}
+
+	return strings.ToUpper(fields[0])
+}
+
+// Analysis reports on every item added so far, listing the top fingerprints by count
+// and by duration
+func (a *Analyzer) Analysis(top int) Analysis {
+	analysis := Analysis{
+		Items:     a.items,
+		Start:     a.first,
+		Finish:    a.last,
+		Interval:  a.interval,
+		Types:     a.types,
+		Commands:  a.commands,
+		Timeline:  make([]AnalysisBucket, len(a.timeline)),
+		Users:     sortedBreakdowns(a.users),
+		Databases: sortedBreakdowns(a.databases),
+	}
+
+	for idx, bucket := range a.timeline {
+		if a.interval > 0 {
+			bucket.ItemsPerSecond = float64(bucket.Items) / a.interval.Seconds()
+		}
+
+		analysis.Timeline[idx] = bucket
+	}
+
+	fingerprints := make([]FingerprintStats, 0, len(a.fingerprints))
+	for _, stats := range a.fingerprints {
+		fingerprints = append(fingerprints, *stats)
+	}
+
+	analysis.TopByCount = topFingerprints(fingerprints, top, func(s FingerprintStats) int64 { return int64(s.Count) })
+	analysis.TopByDuration = topFingerprints(fingerprints, top, func(s FingerprintStats) int64 { return int64(s.Duration) })
+
+	lengths := append([]time.Duration{}, a.lengths...)
+	for _, session := range a.open {
+		lengths = append(lengths, session[1].Sub(session[0]))
+	}
+
+	analysis.Sessions = sessionLengths(lengths)
+	analysis.Sessions.Unfinished = len(a.open)
+
+	return analysis
+}
+
+func topFingerprints(fingerprints []FingerprintStats, top int, by func(FingerprintStats) int64) []FingerprintStats {
+	sorted := append([]FingerprintStats{}, fingerprints...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if by(sorted[i]) != by(sorted[j]) {
+			return by(sorted[i]) > by(sorted[j])
+		}
+
+		return sorted[i].Fingerprint < sorted[j].Fingerprint
+	})
+
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+
+	return sorted
+}
+
+func sortedBreakdowns(breakdowns map[string]*Breakdown) []Breakdown {
+	sorted := make([]Breakdown, 0, len(breakdowns))
+	for _, breakdown := range breakdowns {
+		sorted = append(sorted, *breakdown)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Items != sorted[j].Items {
+			return sorted[i].Items > sorted[j].Items
+		}
+
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted
+}
+
+func sessionLengths(lengths []time.Duration) SessionLengths {
+	sort.Slice(lengths, func(i, j int) bool { return lengths[i] < lengths[j] })
+
+	report := SessionLengths{Total: len(lengths)}
+	for _, under := range sessionLengthBuckets {
+		report.Histogram = append(report.Histogram, LengthBucket{Under: under})
+	}
+	report.Histogram = append(report.Histogram, LengthBucket{})
+
+	if len(lengths) == 0 {
+		return report
+	}
+
+	percentile := func(p float64) time.Duration {
+		return lengths[int(p*float64(len(lengths)-1))]
+	}
+
+	report.P50, report.P90, report.P99 = percentile(0.5), percentile(0.9), percentile(0.99)
+	report.Max = lengths[len(lengths)-1]
+
+	for _, length := range lengths {
+		idx := sort.Search(len(sessionLengthBuckets), func(i int) bool { return length < sessionLengthBuckets[i] })
+		report.Histogram[idx].Count++
+	}
+
+	return report
+}
+
+// WriteText writes the analysis as a human readable report
+func (a Analysis) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Items:\t%d\n", a.Items)
+	fmt.Fprintf(tw, "Start:\t%s\n", a.Start.Format(PostgresTimestampFormat))
+	fmt.Fprintf(tw, "Finish:\t%s\n", a.Finish.Format(PostgresTimestampFormat))
+	fmt.Fprintf(tw, "Duration:\t%s\n", a.Finish.Sub(a.Start))
+
+	fmt.Fprintf(tw, "\nITEM TYPE\tCOUNT\n")
+	for _, label := range sortedKeys(a.Types) {
+		fmt.Fprintf(tw, "%s\t%d\n", label, a.Types[label])
+	}
+
+	fmt.Fprintf(tw, "\nCOMMAND\tCOUNT\n")
+	for _, command := range sortedKeys(a.Commands) {
+		fmt.Fprintf(tw, "%s\t%d\n", command, a.Commands[command])
+	}
+
+	for _, section := range []struct {
+		title        string
+		fingerprints []FingerprintStats
+	}{
+		{"TOP BY COUNT", a.TopByCount},
+		{"TOP BY DURATION", a.TopByDuration},
+	} {
+		fmt.Fprintf(tw, "\n%s\tCOUNT\tDURATION\tMEAN\n", section.title)
+		for _, stats := range section.fingerprints {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", truncate(stats.Fingerprint, 80), stats.Count, stats.Duration, stats.Mean())
+		}
+	}
+
+	fmt.Fprintf(tw, "\nINTERVAL\tITEMS\tITEMS/S\tSESSIONS\n")
+	for _, bucket := range a.Timeline {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%d\n", bucket.Start.Format(PostgresTimestampFormat), bucket.Items, bucket.ItemsPerSecond, bucket.Sessions)
+	}
+
+	fmt.Fprintf(tw, "\nSESSIONS\t%d\n", a.Sessions.Total)
+	fmt.Fprintf(tw, "Unfinished\t%d\n", a.Sessions.Unfinished)
+	fmt.Fprintf(tw, "p50\t%s\n", a.Sessions.P50)
+	fmt.Fprintf(tw, "p90\t%s\n", a.Sessions.P90)
+	fmt.Fprintf(tw, "p99\t%s\n", a.Sessions.P99)
+	fmt.Fprintf(tw, "Max\t%s\n", a.Sessions.Max)
+
+	fmt.Fprintf(tw, "\nSESSION LENGTH\tCOUNT\n")
+	for idx, bucket := range a.Sessions.Histogram {
+		if bucket.Under == 0 {
+			fmt.Fprintf(tw, ">= %s\t%d\n", a.Sessions.Histogram[idx-1].Under, bucket.Count)
+		} else {
+			fmt.Fprintf(tw, "< %s\t%d\n", bucket.Under, bucket.Count)
+		}
+	}
+
+	for _, section := range []struct {
+		title      string
+		breakdowns []Breakdown
+	}{
+		{"USER", a.Users},
+		{"DATABASE", a.Databases},
+	} {
+		fmt.Fprintf(tw, "\n%s\tITEMS\tQUERIES\tSESSIONS\tDURATION\n", section.title)
+		for _, breakdown := range section.breakdowns {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", breakdown.Name, breakdown.Items, breakdown.Queries, breakdown.Sessions, breakdown.Duration)
+		}
+	}
+
+	return tw.Flush()
+}
+
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+
+	return string(runes[:length-3]) + "..."
+}
@@ -0,0 +1,89 @@
+package pgreplay
+
+import (
+	"bytes"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Analyzer", func() {
+	details := func(sessionID SessionID, user string, offset time.Duration) Details {
+		return Details{Timestamp: time20190225.Add(offset), SessionID: sessionID, User: user, Database: "pgreplay_test"}
+	}
+
+	timed := func(details Details, duration time.Duration) Details {
+		details.Duration = duration
+		return details
+	}
+
+	var analysis Analysis
+
+	BeforeEach(func() {
+		analyzer := NewAnalyzer(time.Minute)
+		for _, item := range []Item{
+			Connect{details("a", "alice", 0)},
+			Statement{timed(details("a", "alice", time.Second), time.Millisecond), "select * from users where id = 1"},
+			Connect{details("b", "bob", 30*time.Second)},
+			BoundExecute{Execute{timed(details("b", "bob", 40*time.Second), 5*time.Millisecond), "insert into logs values ($1)"}, []interface{}{"a"}},
+			Statement{timed(details("a", "alice", 70*time.Second), time.Millisecond), "select * from users where id = 2"},
+			Disconnect{details("a", "alice", 80*time.Second)},
+			Statement{details("b", "bob", 200*time.Second), "select * from users where id = 3"},
+		} {
+			analyzer.Add(item)
+		}
+
+		analysis = analyzer.Analysis(1)
+	})
+
+	It("Counts items by type and command", func() {
+		Expect(analysis.Items).To(Equal(7))
+		Expect(analysis.Types).To(Equal(map[string]int{
+			ConnectLabel: 2, StatementLabel: 3, BoundExecuteLabel: 1, DisconnectLabel: 1,
+		}))
+		Expect(analysis.Commands).To(Equal(map[string]int{"SELECT": 3, "INSERT": 1}))
+	})
+
+	It("Ranks fingerprints by count and duration", func() {
+		Expect(analysis.TopByCount).To(Equal([]FingerprintStats{
+			{Fingerprint: "select * from users where id = ?", Count: 3, Timed: 2, Duration: 2 * time.Millisecond},
+		}))
+		Expect(analysis.TopByDuration).To(Equal([]FingerprintStats{
+			{Fingerprint: "insert into logs values (?)", Count: 1, Timed: 1, Duration: 5 * time.Millisecond},
+		}))
+	})
+
+	It("Builds a timeline of throughput and concurrency", func() {
+		Expect(analysis.Timeline).To(HaveLen(4))
+		Expect(analysis.Timeline[0].Items).To(Equal(4))
+		Expect(analysis.Timeline[0].ItemsPerSecond).To(BeNumerically("~", 4.0/60))
+		Expect(analysis.Timeline[0].Sessions).To(Equal(2))
+		Expect(analysis.Timeline[1].Sessions).To(Equal(2))
+		Expect(analysis.Timeline[2]).To(Equal(AnalysisBucket{Start: time20190225.Add(2 * time.Minute), Sessions: 1}))
+		Expect(analysis.Timeline[3].Items).To(Equal(1))
+	})
+
+	It("Measures session lengths, including unfinished sessions", func() {
+		Expect(analysis.Sessions.Total).To(Equal(2))
+		Expect(analysis.Sessions.Unfinished).To(Equal(1))
+		Expect(analysis.Sessions.Max).To(Equal(170 * time.Second))
+		Expect(analysis.Sessions.Histogram[3]).To(Equal(LengthBucket{Under: 10 * time.Minute, Count: 2}))
+	})
+
+	It("Breaks down by user and database", func() {
+		Expect(analysis.Users).To(Equal([]Breakdown{
+			{Name: "alice", Items: 4, Queries: 2, Sessions: 1, Duration: 2 * time.Millisecond},
+			{Name: "bob", Items: 3, Queries: 2, Sessions: 1, Duration: 5 * time.Millisecond},
+		}))
+		Expect(analysis.Databases).To(Equal([]Breakdown{
+			{Name: "pgreplay_test", Items: 7, Queries: 4, Sessions: 2, Duration: 7 * time.Millisecond},
+		}))
+	})
+
+	It("Writes a text report", func() {
+		var buffer bytes.Buffer
+		Expect(analysis.WriteText(&buffer)).To(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("select * from users where id = ?"))
+	})
+})
@@ -0,0 +1,422 @@
+package pgreplay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	anonymisedValuesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgreplay_anonymised_values_total",
+			Help: "Number of values pseudonymised or redacted, by kind of value",
+		},
+		[]string{"kind"},
+	)
+)
+
+// RedactedPassword replaces the password of every PASSWORD clause
+const RedactedPassword = "redacted"
+
+// Anonymiser removes sensitive values from items, so that workloads can leave the
+// network they were captured in.
+//
+// String literals in queries and the values of bind parameters are replaced with keyed,
+// deterministic pseudonyms: the same value always maps to the same pseudonym under the
+// same key, so joins and lookups on pseudonymised data still find their rows. Pseudonyms
+// keep the shape of the original, replacing each letter with a letter and each digit
+// with a digit, so that values still fit their columns. Quoted numbers, such as card or
+// phone numbers, are text and pseudonymised digit for digit. Numbers are left alone,
+// whether written into the query or bound as parameters, so that both forms of a lookup
+// still match and LIMITs keep their meaning. Booleans are also left alone, as are
+// dollar-quoted strings, which usually hold function bodies.
+//
+// Values in allowed columns, or matching an allowed pattern, are kept as they were.
+// PASSWORD clauses are always redacted, whatever the allowlists say, and even without a
+// key.
+type Anonymiser struct {
+	key []byte
+
+	// AllowColumns lists columns whose values are kept, matched case-insensitively
+	// against the column a value is compared with or inserted into
+	AllowColumns []string
+	// AllowValues lists patterns for values that are kept
+	AllowValues []*regexp.Regexp
+}
+
+// NewAnonymiser pseudonymises values with the given key, or only redacts passwords if the
+// key is empty
+func NewAnonymiser(key []byte) *Anonymiser {
+	return &Anonymiser{key: key}
+}
+
+// unremarkableValue matches booleans, which identify nothing and would no longer be
+// booleans if pseudonymised, so we leave them alone
+var unremarkableValue = regexp.MustCompile(`^(t|f|true|false)$`)
+
+// numericValue matches bind parameters that are numbers, which Postgres logs as strings
+var numericValue = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+// hexValue matches values such as UUIDs and hashes, whose pseudonyms should remain hex
+var hexValue = regexp.MustCompile(`^[0-9a-fA-F-]+$`)
+
+// Apply anonymises each item
+func (a *Anonymiser) Apply(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		for item := range items {
+			if item != nil {
+				out <- a.Anonymise(item)
+			}
+		}
+	}()
+
+	return out
+}
+
+// Anonymise returns a copy of the item without its sensitive values
+func (a *Anonymiser) Anonymise(item Item) Item {
+	switch item := item.(type) {
+	case Statement:
+		item.Query, _ = a.anonymiseQuery(item.Query)
+		return item
+	case *Statement:
+		return a.Anonymise(*item)
+	case BoundExecute:
+		query, parameterColumns := a.anonymiseQuery(item.Query)
+		item.Query = query
+
+		parameters := make([]interface{}, len(item.Parameters))
+		for idx, parameter := range item.Parameters {
+			parameters[idx] = parameter
+
+			value, ok := parameter.(string)
+			if !ok || len(a.key) == 0 || numericValue.MatchString(value) || a.allowed(value, parameterColumns[idx+1]) {
+				continue
+			}
+
+			anonymisedValuesTotal.WithLabelValues("parameter").Inc()
+			parameters[idx] = a.pseudonym(value, escapeNone)
+		}
+
+		item.Parameters = parameters
+		return item
+	case *BoundExecute:
+		return a.Anonymise(*item)
+	}
+
+	return item
+}
+
+// anonymiseQuery rewrites the string literals of a query, returning the columns each
+// bind parameter was compared with or inserted into so that parameters can be checked
+// against the allowlist
+func (a *Anonymiser) anonymiseQuery(query string) (string, map[int][]string) {
+	tokens := tokenizeQuery(query)
+	parameterColumns := map[int][]string{}
+
+	var anonymised strings.Builder
+	last := 0
+
+	for idx, token := range tokens {
+		switch token.kind {
+		case tokenParameter:
+			if number, err := strconv.Atoi(query[token.start+1 : token.end]); err == nil {
+				parameterColumns[number] = append(parameterColumns[number], columnFor(tokens, idx))
+			}
+		case tokenLiteral:
+			// Passwords may be dollar-quoted, which we replace with a plain string
+			if query[token.start] != '$' || !isPasswordClause(tokens, idx) {
+				continue
+			}
+
+			anonymisedValuesTotal.WithLabelValues("password").Inc()
+			anonymised.WriteString(query[last:token.start])
+			anonymised.WriteString("'" + RedactedPassword + "'")
+			last = token.end
+		case tokenString:
+			raw := query[token.start:token.end]
+			prefix, value, escapes := unquoteString(raw)
+
+			var replacement string
+			switch {
+			case isPasswordClause(tokens, idx):
+				anonymisedValuesTotal.WithLabelValues("password").Inc()
+				replacement = RedactedPassword
+			case len(a.key) == 0 || a.allowed(value, []string{columnFor(tokens, idx)}):
+				continue
+			default:
+				anonymisedValuesTotal.WithLabelValues("literal").Inc()
+				replacement = a.pseudonym(value, escapes)
+			}
+
+			if escapes == escapeNone {
+				replacement = strings.ReplaceAll(replacement, "'", "''")
+			}
+
+			anonymised.WriteString(query[last:token.start])
+			anonymised.WriteString(prefix + "'" + replacement + "'")
+			last = token.end
+		}
+	}
+
+	if last == 0 {
+		return query, parameterColumns
+	}
+
+	anonymised.WriteString(query[last:])
+	return anonymised.String(), parameterColumns
+}
+
+func (a *Anonymiser) allowed(value string, columns []string) bool {
+	if unremarkableValue.MatchString(value) {
+		return true
+	}
+
+	for _, pattern := range a.AllowValues {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+
+	for _, column := range columns {
+		for _, allowed := range a.AllowColumns {
+			if column != "" && strings.EqualFold(column, allowed) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// escapeStyle describes how backslashes escape characters in a string's value
+type escapeStyle int
+
+const (
+	escapeNone      escapeStyle = iota // backslashes are ordinary characters
+	escapeBackslash                    // E strings, where a backslash escapes what follows
+	escapeUnicode                      // U& strings, where a backslash starts a code point
+)
+
+// pseudonym maps a value onto another of the same shape, derived from an HMAC of the
+// value. Escaped values are the body of an E or U& prefixed string, and we leave their
+// escape sequences alone so as not to create invalid ones.
+func (a *Anonymiser) pseudonym(value string, escapes escapeStyle) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(value))
+	seed := mac.Sum(nil)
+
+	// Extend the HMAC into as many bytes as we need, by chaining further HMACs from it
+	var stream []byte
+	next := func() byte {
+		if len(stream) == 0 {
+			block := hmac.New(sha256.New, a.key)
+			block.Write(seed)
+			seed = block.Sum(nil)
+			stream = append([]byte{}, seed...)
+		}
+
+		b := stream[0]
+		stream = stream[1:]
+
+		return b
+	}
+
+	hex := hexValue.MatchString(value)
+
+	// After a backslash, escaped counts the characters of the escape sequence we've yet to
+	// pass over
+	backslash, escaped := false, 0
+
+	var pseudonym strings.Builder
+	for _, r := range value {
+		switch {
+		case backslash:
+			backslash = false
+
+			// Unicode escapes are \\, \XXXX or \+XXXXXX
+			if escapes == escapeUnicode && r != '\\' {
+				escaped = 3
+				if r == '+' {
+					escaped = 6
+				}
+			}
+		case escaped > 0:
+			escaped--
+		case escapes != escapeNone && r == '\\':
+			backslash = true
+		case r >= '0' && r <= '9':
+			r = '0' + rune(next()%10)
+		case hex && r >= 'a' && r <= 'f':
+			r = 'a' + rune(next()%6)
+		case hex && r >= 'A' && r <= 'F':
+			r = 'A' + rune(next()%6)
+		case r >= 'A' && r <= 'Z':
+			r = 'A' + rune(next()%26)
+		case unicode.IsLetter(r):
+			r = 'a' + rune(next()%26)
+		}
+
+		pseudonym.WriteRune(r)
+	}
+
+	return pseudonym.String()
+}
+
+// unquoteString splits a quoted string token into its prefix, as in E, and its value.
+// Strings with backslash escapes are left escaped, as pseudonyms preserve every escape,
+// while doubled quotes are unescaped from any other string.
+func unquoteString(raw string) (prefix, value string, escapes escapeStyle) {
+	quote := strings.IndexByte(raw, '\'')
+	prefix, body := raw[:quote], strings.TrimSuffix(raw[quote+1:], "'")
+
+	switch {
+	case strings.EqualFold(prefix, "e"):
+		return prefix, body, escapeBackslash
+	case strings.EqualFold(prefix, "u&"):
+		return prefix, body, escapeUnicode
+	}
+
+	return prefix, strings.ReplaceAll(body, "''", "'"), escapeNone
+}
+
+// isPasswordClause identifies the password in statements such as ALTER ROLE ... PASSWORD
+// '...', however it is quoted
+func isPasswordClause(tokens []queryToken, idx int) bool {
+	return idx > 0 && tokens[idx-1].text == "password"
+}
+
+// columnFor finds the column a constant is compared with, as in col = 'a' or col IN
+// ('a', 'b'), or inserted into, returning an empty string if there isn't one
+func columnFor(tokens []queryToken, idx int) string {
+	// Skip back over the rest of an IN list
+	start := idx - 1
+	for start >= 0 && (tokens[start].constant() || tokens[start].text == ",") {
+		start--
+	}
+
+	if start >= 1 && tokens[start].text == "(" && tokens[start-1].text == "in" {
+		column := start - 2
+		if column >= 0 && tokens[column].text == "not" {
+			column--
+		}
+
+		return identifierAt(tokens, column)
+	}
+
+	// Skip back over a comparison
+	column := idx - 1
+	for column >= 0 && isComparison(tokens[column]) {
+		column--
+	}
+
+	if column < idx-1 {
+		return identifierAt(tokens, column)
+	}
+
+	return insertColumnFor(tokens, idx)
+}
+
+func isComparison(token queryToken) bool {
+	switch token.text {
+	case "=", "<", ">", "!", "~", "like", "ilike", "not":
+		return true
+	}
+
+	return false
+}
+
+// identifierAt returns the name of the identifier at idx, without quotes, or an empty
+// string if it isn't an identifier. Qualified names, as in users.email, end with the
+// column.
+func identifierAt(tokens []queryToken, idx int) string {
+	if idx < 0 || tokens[idx].kind != tokenIdentifier {
+		return ""
+	}
+
+	return strings.Trim(tokens[idx].text, `"`)
+}
+
+// insertColumnFor finds the column a constant is inserted into, for constants that are
+// elements of INSERT INTO table (columns...) VALUES (values...), (values...)
+func insertColumnFor(tokens []queryToken, idx int) string {
+	// Find the start of the tuple, counting the elements before ours
+	position, open := 0, idx-1
+	for ; open >= 0 && tokens[open].text != "("; open-- {
+		switch tokens[open].text {
+		case ",":
+			position++
+		case ")":
+			open = matchingOpen(tokens, open) // skip over expressions, as in lower('a')
+		}
+	}
+
+	// Skip any earlier tuples, to find VALUES
+	before := open - 1
+	for before >= 1 && tokens[before].text == "," && tokens[before-1].text == ")" {
+		before = matchingOpen(tokens, before-1) - 1
+	}
+
+	if before < 1 || tokens[before].text != "values" || tokens[before-1].text != ")" {
+		return ""
+	}
+
+	// Collect the column list that precedes VALUES
+	var columns []string
+	for column := matchingOpen(tokens, before-1) + 1; column < before-1; column++ {
+		if tokens[column].kind == tokenIdentifier {
+			columns = append(columns, strings.Trim(tokens[column].text, `"`))
+		}
+	}
+
+	if position >= len(columns) {
+		return ""
+	}
+
+	return columns[position]
+}
+
+// matchingOpen returns the index of the bracket that opens the one closed at idx, or -1
+func matchingOpen(tokens []queryToken, idx int) int {
+	depth := 0
+	for ; idx >= 0; idx-- {
+		switch tokens[idx].text {
+		case ")":
+			depth++
+		case "(":
+			depth--
+			if depth == 0 {
+				return idx
+			}
+		}
+	}
+
+	return -1
+}
+
+// ParseAnonymiseKey decodes a key read from a file or the environment, trimming any
+// trailing newline. Short keys are rejected, as they make pseudonyms easy to reverse.
+func ParseAnonymiseKey(key string) ([]byte, error) {
+	return parseKey(key)
+}
+
+func parseKey(key string) ([]byte, error) {
+	key = strings.TrimRight(key, "\r\n")
+	if len(key) < 16 {
+		return nil, errors.New("key must be at least 16 bytes")
+	}
+
+	return []byte(key), nil
+}
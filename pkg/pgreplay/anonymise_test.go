@@ -0,0 +1,144 @@
+package pgreplay
+
+import (
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Anonymiser", func() {
+	details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+	var anonymiser *Anonymiser
+
+	BeforeEach(func() {
+		anonymiser = NewAnonymiser([]byte("0123456789abcdef"))
+	})
+
+	query := func(query string) string {
+		return anonymiser.Anonymise(Statement{details, query}).(Statement).Query
+	}
+
+	parameters := func(query string, parameters ...interface{}) []interface{} {
+		return anonymiser.Anonymise(BoundExecute{Execute{details, query}, parameters}).(BoundExecute).Parameters
+	}
+
+	It("Pseudonymises string literals, keeping their shape", func() {
+		anonymised := query("select * from users where email = 'Alice.Smith@example.com'")
+
+		Expect(anonymised).NotTo(ContainSubstring("Alice"))
+		Expect(anonymised).To(MatchRegexp(`^select \* from users where email = '[A-Z][a-z]{4}\.[A-Z][a-z]{4}@[a-z]{7}\.[a-z]{3}'$`))
+	})
+
+	It("Maps equal values to equal pseudonyms across literals and parameters", func() {
+		literal := regexp.MustCompile(`'(.*)'`).FindStringSubmatch(query("select 1 from users where name = 'alice'"))[1]
+
+		Expect(query("select 1 from accounts where owner = 'alice'")).To(ContainSubstring("'" + literal + "'"))
+		Expect(parameters("select 1 from users where name = $1", "alice")).To(Equal([]interface{}{literal}))
+	})
+
+	It("Depends on the key", func() {
+		other := NewAnonymiser([]byte("fedcba9876543210"))
+
+		Expect(other.Anonymise(Statement{details, "select 'alice'"})).NotTo(
+			Equal(anonymiser.Anonymise(Statement{details, "select 'alice'"})),
+		)
+	})
+
+	It("Leaves numbers alone, whether written into the query or bound", func() {
+		Expect(query("select * from users where id = 42 limit 10")).To(Equal("select * from users where id = 42 limit 10"))
+		Expect(parameters("select * from users where id = $1 limit $2", "42", "10")).To(Equal([]interface{}{"42", "10"}))
+		Expect(parameters("select $1, $2, $3, $4, $5", "-1.5", "1e-3", "t", nil, 42)).To(
+			Equal([]interface{}{"-1.5", "1e-3", "t", nil, 42}),
+		)
+	})
+
+	It("Pseudonymises quoted numbers digit for digit", func() {
+		anonymised := query("select 1 from users where phone = '+44 7700 900123' and card = '4111111111111111' and active = 't'")
+
+		Expect(anonymised).To(MatchRegexp(`^select 1 from users where phone = '\+\d{2} \d{4} \d{6}' and card = '\d{16}' and active = 't'$`))
+		Expect(anonymised).NotTo(ContainSubstring("7700 900123"))
+		Expect(anonymised).NotTo(ContainSubstring("4111111111111111"))
+	})
+
+	It("Leaves the escapes of unicode strings intact", func() {
+		Expect(query(`select U&'d\0061t\+000061 \\ ok'`)).To(MatchRegexp(`^select U&'[a-z]\\0061[a-z]\\\+000061 \\\\ [a-z]{2}'$`))
+	})
+
+	It("Keeps hex values hex, so UUIDs remain valid", func() {
+		Expect(parameters("select $1", "550e8400-e29b-41d4-a716-446655440000")[0]).To(
+			MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`),
+		)
+	})
+
+	It("Escapes quotes in pseudonyms", func() {
+		Expect(query("select 'o''brien', E'it\\'s'")).To(MatchRegexp(`^select '[a-z]''[a-z]{5}', E'[a-z]{2}\\'[a-z]'$`))
+	})
+
+	Context("With allowlists", func() {
+		BeforeEach(func() {
+			anonymiser.AllowColumns = []string{"status", "Country"}
+			anonymiser.AllowValues = []*regexp.Regexp{regexp.MustCompile(`^internal_`)}
+		})
+
+		It("Keeps values compared with allowed columns", func() {
+			anonymised := query("select 1 from payments p where p.status = 'paid' and p.reference = 'xyz'")
+
+			Expect(anonymised).To(MatchRegexp(`^select 1 from payments p where p.status = 'paid' and p.reference = '[a-z]{3}'$`))
+			Expect(anonymised).NotTo(ContainSubstring("xyz"))
+			Expect(query(`select 1 from users where "country" not in ('GB', 'FR')`)).To(ContainSubstring("('GB', 'FR')"))
+		})
+
+		It("Keeps values inserted into allowed columns", func() {
+			Expect(parameters("insert into users (email, country) values ($1, $2), ($3, $4)", "a@b.c", "GB", "d@e.f", "FR")).To(
+				ConsistOf(Not(Equal("a@b.c")), "GB", Not(Equal("d@e.f")), "FR"),
+			)
+		})
+
+		It("Keeps values matching allowed patterns", func() {
+			Expect(parameters("select $1", "internal_job")).To(Equal([]interface{}{"internal_job"}))
+		})
+	})
+
+	It("Always redacts passwords", func() {
+		anonymiser.AllowValues = []*regexp.Regexp{regexp.MustCompile(`.*`)}
+
+		Expect(query("ALTER ROLE alice WITH ENCRYPTED PASSWORD 'hunter2'")).To(
+			Equal("ALTER ROLE alice WITH ENCRYPTED PASSWORD 'redacted'"),
+		)
+		Expect(NewAnonymiser(nil).Anonymise(Statement{details, "create user bob password 'hunter2' login"})).To(
+			Equal(Statement{details, "create user bob password 'redacted' login"}),
+		)
+	})
+
+	DescribeTable("Redacts passwords however they're quoted",
+		func(clause, expected string) {
+			Expect(NewAnonymiser(nil).Anonymise(Statement{details, "alter role alice password " + clause + " login"})).To(
+				Equal(Statement{details, "alter role alice password " + expected + " login"}),
+			)
+		},
+		Entry("plain", "'hunter2'", "'redacted'"),
+		Entry("with escapes", `E'hunter\'2'`, "E'redacted'"),
+		Entry("with lowercase escapes", `e'hunter2'`, "e'redacted'"),
+		Entry("national", "N'hunter2'", "N'redacted'"),
+		Entry("unicode", `U&'hunter\0032'`, "U&'redacted'"),
+		Entry("dollar quoted", "$$hunter2$$", "'redacted'"),
+		Entry("tagged dollar quotes", "$pw$hunter2$pw$", "'redacted'"),
+	)
+
+	It("Lets users keep quoted numbers through the value allowlist", func() {
+		anonymiser.AllowValues = []*regexp.Regexp{regexp.MustCompile(`^\d+$`)}
+
+		Expect(query("select '42', '4a'")).To(MatchRegexp(`^select '42', '\d[a-z]'$`))
+	})
+
+	It("Only redacts passwords without a key", func() {
+		anonymiser = NewAnonymiser(nil)
+
+		Expect(query("select * from users where email = 'alice@example.com'")).To(
+			Equal("select * from users where email = 'alice@example.com'"),
+		)
+	})
+})
@@ -0,0 +1,279 @@
+package pgreplay
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	checkpointLastTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_checkpoint_last_timestamp",
+			Help: "Log timestamp of the most recently saved checkpoint",
+		},
+	)
+	checkpointErrorsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_checkpoint_errors_total",
+			Help: "Number of times we failed to save a checkpoint",
+		},
+	)
+)
+
+const (
+	// ResumeReopen reconnects sessions that were active at the checkpoint, so they can
+	// continue with their remaining items
+	ResumeReopen = "reopen"
+	// ResumeSkip discards the remaining items of sessions that were active at the
+	// checkpoint, as their connection state can't be reconstructed
+	ResumeSkip = "skip"
+)
+
+// Checkpoint records how far a replay has progressed, allowing it to be resumed
+type Checkpoint struct {
+	// Timestamp is the most recent log time for which every item has been dispatched
+	Timestamp time.Time `json:"timestamp"`
+	// Offset is a position in the input file at or before the first item following
+	// Timestamp. It is zero for input formats that can't track offsets, in which case we
+	// resume by reading from the start of the file.
+	Offset int64 `json:"offset"`
+	// Sessions are those that were connected at Timestamp
+	Sessions []Details `json:"sessions"`
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{}
+	return checkpoint, json.Unmarshal(payload, checkpoint)
+}
+
+// Save writes the checkpoint to a temporary file before renaming it into place, so a
+// crash mid-write never leaves us with a corrupt checkpoint.
+func (c Checkpoint) Save(path string) error {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Resume discards every item up to and including the checkpoint timestamp. Sessions that
+// were active at the checkpoint are then either reopened, by sending a Connect for each
+// before any other item, or skipped until they next disconnect.
+func (c Checkpoint) Resume(items chan Item, reopen bool) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		skipping := map[SessionID]bool{}
+		for _, details := range c.Sessions {
+			if reopen {
+				details.Timestamp = c.Timestamp
+				out <- Connect{details}
+			} else {
+				skipping[details.SessionID] = true
+			}
+		}
+
+		for item := range items {
+			if item == nil || !item.GetTimestamp().After(c.Timestamp) {
+				continue
+			}
+
+			if skipping[item.GetSessionID()] {
+				switch item.(type) {
+				case Disconnect, *Disconnect:
+					delete(skipping, item.GetSessionID())
+				}
+
+				continue
+			}
+
+			out <- item
+		}
+	}()
+
+	return out
+}
+
+var _ Observer = &Checkpointer{}
+
+// Checkpointer is an Observer that periodically saves a Checkpoint of the replay's
+// progress, based on the items that have been dispatched.
+//
+// Checkpoints are only taken when we move onto a new timestamp, as that's when we know
+// every item at the previous timestamp has been dispatched.
+type Checkpointer struct {
+	NopObserver
+
+	path     string
+	interval time.Duration
+	logger   kitlog.Logger
+
+	mu            sync.Mutex
+	lastSaved     time.Time
+	seenItem      bool
+	previousTs    time.Time // the last timestamp for which every item was dispatched
+	currentTs     time.Time
+	currentOffset int64 // offset of the first item at currentTs
+	sessions      map[SessionID]Details
+	// changed holds the state of each session we've touched at currentTs as it was
+	// before, or nil if it wasn't connected, so we can checkpoint previousTs if we stop
+	// partway through currentTs
+	changed map[SessionID]*Details
+}
+
+func NewCheckpointer(path string, interval time.Duration, logger kitlog.Logger) *Checkpointer {
+	return &Checkpointer{
+		path:      path,
+		interval:  interval,
+		logger:    logger,
+		lastSaved: time.Now(),
+		sessions:  map[SessionID]Details{},
+		changed:   map[SessionID]*Details{},
+	}
+}
+
+// Seed initialises our view of the replay from the checkpoint we resumed from, so our
+// first checkpoint includes sessions that were reopened.
+func (c *Checkpointer) Seed(checkpoint Checkpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.previousTs = checkpoint.Timestamp
+	for _, details := range checkpoint.Sessions {
+		c.sessions[details.SessionID] = details
+	}
+}
+
+func (c *Checkpointer) ItemDispatched(item Item) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// If we've moved onto a new timestamp, we've dispatched everything before it and can
+	// checkpoint if we're due
+	if ts := item.GetTimestamp(); !c.seenItem || ts.After(c.currentTs) {
+		if c.seenItem && time.Since(c.lastSaved) >= c.interval {
+			c.save(Checkpoint{c.currentTs, SourceOffset(item), c.activeSessions()})
+		}
+
+		if c.seenItem {
+			c.previousTs = c.currentTs
+		}
+
+		c.seenItem, c.currentTs, c.currentOffset = true, ts, SourceOffset(item)
+		c.changed = map[SessionID]*Details{}
+	}
+
+	if _, ok := c.changed[item.GetSessionID()]; !ok {
+		var before *Details
+		if details, ok := c.sessions[item.GetSessionID()]; ok {
+			before = &details
+		}
+
+		c.changed[item.GetSessionID()] = before
+	}
+
+	switch item.(type) {
+	case Disconnect, *Disconnect:
+		delete(c.sessions, item.GetSessionID())
+	default:
+		if _, ok := c.sessions[item.GetSessionID()]; !ok {
+			c.sessions[item.GetSessionID()] = Details{
+				SessionID: item.GetSessionID(),
+				User:      item.GetUser(),
+				Database:  item.GetDatabase(),
+			}
+		}
+	}
+}
+
+// ReplayFinished saves a final checkpoint, covering every item that was dispatched. If
+// the replay was interrupted we may have stopped partway through the current timestamp,
+// so we checkpoint the one before it, and resuming dispatches the whole of the current
+// timestamp again.
+func (c *Checkpointer) ReplayFinished(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.seenItem {
+		return
+	}
+
+	if err == nil {
+		c.save(Checkpoint{c.currentTs, c.currentOffset, c.activeSessions()})
+		return
+	}
+
+	sessions := map[SessionID]Details{}
+	for sessionID, details := range c.sessions {
+		sessions[sessionID] = details
+	}
+
+	for sessionID, before := range c.changed {
+		if before == nil {
+			delete(sessions, sessionID)
+		} else {
+			sessions[sessionID] = *before
+		}
+	}
+
+	c.save(Checkpoint{c.previousTs, c.currentOffset, sortSessions(sessions)})
+}
+
+func (c *Checkpointer) activeSessions() []Details {
+	return sortSessions(c.sessions)
+}
+
+func sortSessions(byID map[SessionID]Details) []Details {
+	sessions := make([]Details, 0, len(byID))
+	for _, details := range byID {
+		sessions = append(sessions, details)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].SessionID < sessions[j].SessionID
+	})
+
+	return sessions
+}
+
+func (c *Checkpointer) save(checkpoint Checkpoint) {
+	c.lastSaved = time.Now()
+	if err := checkpoint.Save(c.path); err != nil {
+		checkpointErrorsTotal.Inc()
+		c.logger.Log("event", "checkpoint.error", "error", err)
+		return
+	}
+
+	checkpointLastTimestamp.Set(float64(checkpoint.Timestamp.Unix()))
+}
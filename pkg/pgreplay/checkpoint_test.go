@@ -0,0 +1,150 @@
+package pgreplay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checkpoint", func() {
+	var (
+		dir, path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "pgreplay")
+		Expect(err).NotTo(HaveOccurred())
+
+		path = filepath.Join(dir, "checkpoint.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Saves and loads", func() {
+		checkpoint := Checkpoint{time20190225, 1024, []Details{detailsAt(0, "a")}}
+		Expect(checkpoint.Save(path)).To(Succeed())
+
+		loaded, err := LoadCheckpoint(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.Timestamp.Equal(checkpoint.Timestamp)).To(BeTrue())
+		Expect(loaded.Offset).To(Equal(int64(1024)))
+		Expect(loaded.Sessions).To(HaveLen(1))
+	})
+
+	Describe("Resume", func() {
+		var (
+			checkpoint = Checkpoint{Timestamp: time20190225.Add(time.Second), Sessions: []Details{detailsAt(0, "a")}}
+			items      chan Item
+		)
+
+		BeforeEach(func() {
+			items = make(chan Item, 4)
+			items <- Statement{detailsAt(time.Second, "a"), "already dispatched"}
+			items <- Statement{detailsAt(2*time.Second, "a"), "select 1"}
+			items <- Disconnect{detailsAt(3*time.Second, "a")}
+			items <- Statement{detailsAt(4*time.Second, "b"), "select 2"}
+			close(items)
+		})
+
+		It("Reopens active sessions", func() {
+			resumed := collect(checkpoint.Resume(items, true))
+
+			Expect(resumed).To(HaveLen(4))
+			Expect(resumed[0]).To(Equal(Connect{
+				Details{Timestamp: checkpoint.Timestamp, SessionID: "a", User: "alice", Database: "pgreplay_test"},
+			}))
+			Expect(resumed[1].(Statement).Query).To(Equal("select 1"))
+		})
+
+		It("Skips active sessions until they disconnect", func() {
+			resumed := collect(checkpoint.Resume(items, false))
+
+			Expect(resumed).To(HaveLen(1))
+			Expect(resumed[0].(Statement).Query).To(Equal("select 2"))
+		})
+	})
+
+	Describe("Checkpointer", func() {
+		It("Records the offset of the first item following a fully dispatched timestamp", func() {
+			input := strings.Join([]string{
+				`{"type":"Connect","item":{"timestamp":"2019-02-25T15:08:27.222Z","session_id":"a"}}`,
+				`{"type":"Statement","item":{"timestamp":"2019-02-25T15:08:27.222Z","session_id":"a","query":"select 1"}}`,
+				`{"type":"Statement","item":{"timestamp":"2019-02-25T15:08:28.222Z","session_id":"b","query":"select 2"}}`,
+			}, "\n")
+
+			parsed, _, _ := ParseJSON(strings.NewReader(input))
+			checkpointer := NewCheckpointer(path, 0, kitlog.NewNopLogger())
+
+			for item := range parsed {
+				checkpointer.ItemDispatched(item)
+			}
+
+			loaded, err := LoadCheckpoint(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.Timestamp.Equal(time20190225)).To(BeTrue())
+			Expect(loaded.Offset).To(Equal(int64(strings.LastIndex(input, "\n") + 1)))
+			Expect(loaded.Sessions).To(ConsistOf(
+				Details{SessionID: "a"},
+			))
+		})
+
+		It("Resumes the whole of a timestamp we stopped partway through", func() {
+			input := strings.Join([]string{
+				`{"type":"Connect","item":{"timestamp":"2019-02-25T15:08:27.222Z","session_id":"a"}}`,
+				`{"type":"Statement","item":{"timestamp":"2019-02-25T15:08:27.222Z","session_id":"a","query":"select 1"}}`,
+				`{"type":"Connect","item":{"timestamp":"2019-02-25T15:08:28.222Z","session_id":"b"}}`,
+				`{"type":"Statement","item":{"timestamp":"2019-02-25T15:08:28.222Z","session_id":"b","query":"select 2"}}`,
+				`{"type":"Statement","item":{"timestamp":"2019-02-25T15:08:28.222Z","session_id":"a","query":"select 3"}}`,
+			}, "\n")
+
+			items, _, _ := ParseJSON(strings.NewReader(input))
+			parsed := collect(items)
+			checkpointer := NewCheckpointer(path, time.Hour, kitlog.NewNopLogger())
+
+			// Stop after dispatching the Connect and first statement of the second timestamp
+			for _, item := range parsed[:4] {
+				checkpointer.ItemDispatched(item)
+			}
+
+			checkpointer.ReplayFinished(context.Canceled)
+
+			loaded, err := LoadCheckpoint(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.Timestamp.Equal(time20190225)).To(BeTrue())
+			Expect(loaded.Sessions).To(ConsistOf(Details{SessionID: "a"}))
+
+			remaining, _, _ := ParseJSON(strings.NewReader(input[loaded.Offset:]))
+			resumed := collect(loaded.Resume(remaining, true))
+
+			Expect(resumed).To(HaveLen(4))
+			Expect(resumed[0]).To(BeAssignableToTypeOf(Connect{}))
+			Expect(resumed[0].GetSessionID()).To(Equal(SessionID("a")))
+			Expect(resumed[1]).To(BeAssignableToTypeOf(&Connect{}))
+			Expect(resumed[1].GetSessionID()).To(Equal(SessionID("b")))
+			Expect(resumed[2].(*Statement).Query).To(Equal("select 2"))
+			Expect(resumed[3].(*Statement).Query).To(Equal("select 3"))
+		})
+
+		It("Covers the last timestamp when the replay finishes cleanly", func() {
+			checkpointer := NewCheckpointer(path, time.Hour, kitlog.NewNopLogger())
+			checkpointer.ItemDispatched(Connect{detailsAt(0, "a")})
+			checkpointer.ItemDispatched(Statement{detailsAt(time.Second, "a"), "select 1"})
+			checkpointer.ReplayFinished(nil)
+
+			loaded, err := LoadCheckpoint(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.Timestamp.Equal(time20190225.Add(time.Second))).To(BeTrue())
+			Expect(loaded.Sessions).To(HaveLen(1))
+		})
+	})
+})
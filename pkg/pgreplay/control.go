@@ -0,0 +1,212 @@
+package pgreplay
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	replayRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_replay_rate",
+			Help: "Current rate of playback, as a multiple of the original speed",
+		},
+	)
+	replayPaused = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_replay_paused",
+			Help: "Set to 1 whenever the replay has been paused through the control API",
+		},
+	)
+)
+
+// Controller allows a running replay to be paused, resumed, stopped or have its rate
+// changed. Every change closes the channel returned by the previous call to State, which
+// allows the Streamer to wake and rebase its schedule.
+type Controller struct {
+	mu         sync.Mutex
+	rate       float64
+	paused     bool
+	overridden bool
+	changed    chan struct{}
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func NewController() *Controller {
+	return &Controller{rate: 1, changed: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// State returns the current rate and whether we're paused, along with a channel that
+// will be closed as soon as either changes.
+func (c *Controller) State() (rate float64, paused bool, changed <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rate, c.paused, c.changed
+}
+
+func (c *Controller) Rate() float64 {
+	rate, _, _ := c.State()
+	return rate
+}
+
+func (c *Controller) SetRate(rate float64) error {
+	if err := validateRate(rate); err != nil {
+		return err
+	}
+
+	c.update(func() { c.setRate(rate) })
+
+	return nil
+}
+
+// SetScheduledRate sets the rate on behalf of a rate schedule, unless an operator has
+// already overridden it. Checking and setting happen atomically, so an override can never
+// be lost to a schedule that was about to change the rate.
+func (c *Controller) SetScheduledRate(rate float64) error {
+	if err := validateRate(rate); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.overridden {
+		c.setRate(rate)
+		c.notify()
+	}
+
+	return nil
+}
+
+// OverrideRate sets the rate on behalf of an operator, which takes precedence over any
+// rate schedule the Streamer was following.
+func (c *Controller) OverrideRate(rate float64) error {
+	if err := validateRate(rate); err != nil {
+		return err
+	}
+
+	c.update(func() {
+		c.setRate(rate)
+		c.overridden = true
+	})
+
+	return nil
+}
+
+// Overridden is true once the rate has been set through OverrideRate
+func (c *Controller) Overridden() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.overridden
+}
+
+func (c *Controller) Pause() {
+	c.update(func() { c.paused = true })
+	replayPaused.Set(1)
+}
+
+func (c *Controller) Resume() {
+	c.update(func() { c.paused = false })
+	replayPaused.Set(0)
+}
+
+// Stop requests the replay end, as if it had received a SIGTERM. It is up to whoever
+// started the replay to act on the Stopped channel.
+func (c *Controller) Stop() {
+	c.stopOnce.Do(func() { close(c.stopped) })
+}
+
+func (c *Controller) Stopped() <-chan struct{} {
+	return c.stopped
+}
+
+func (c *Controller) update(apply func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	apply()
+	c.notify()
+}
+
+// notify wakes anyone waiting on the channel from State. It must be called with mu held.
+func (c *Controller) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// setRate must be called with mu held, so the gauge always agrees with the rate
+func (c *Controller) setRate(rate float64) {
+	c.rate = rate
+	replayRate.Set(rate)
+}
+
+func validateRate(rate float64) error {
+	if rate <= 0 {
+		return fmt.Errorf("replay rate must be positive: %v", rate)
+	}
+
+	return nil
+}
+
+// ServeHTTP implements the control API, which expects POST requests to:
+//
+//	/control/pause
+//	/control/resume
+//	/control/rate?value=2.5
+//	/control/stop
+//
+// Changing the rate through the API stops the replay from following any rate schedule.
+// Each request responds with the state of the replay after applying the change.
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "control endpoints require POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/control/pause":
+		c.Pause()
+	case "/control/resume":
+		c.Resume()
+	case "/control/rate":
+		rate, err := strconv.ParseFloat(r.URL.Query().Get("value"), 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid rate value: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := c.OverrideRate(rate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "/control/stop":
+		c.Stop()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	rate, paused, _ := c.State()
+	stopped := false
+	select {
+	case <-c.stopped:
+		stopped = true
+	default:
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rate    float64 `json:"rate"`
+		Paused  bool    `json:"paused"`
+		Stopped bool    `json:"stopped"`
+	}{rate, paused, stopped})
+}
@@ -0,0 +1,103 @@
+package pgreplay
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Controller", func() {
+	var (
+		controller *Controller
+	)
+
+	BeforeEach(func() {
+		controller = NewController()
+	})
+
+	request := func(method, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		controller.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	It("Signals changes by closing the state channel", func() {
+		_, _, changed := controller.State()
+		Expect(changed).NotTo(BeClosed())
+
+		controller.Pause()
+		Expect(changed).To(BeClosed())
+
+		_, paused, changed := controller.State()
+		Expect(paused).To(BeTrue())
+		Expect(changed).NotTo(BeClosed())
+	})
+
+	It("Pauses and resumes", func() {
+		Expect(request("POST", "/control/pause").Body.String()).To(
+			MatchJSON(`{"rate": 1, "paused": true, "stopped": false}`),
+		)
+		Expect(request("POST", "/control/resume").Body.String()).To(
+			MatchJSON(`{"rate": 1, "paused": false, "stopped": false}`),
+		)
+	})
+
+	It("Changes the rate", func() {
+		Expect(request("POST", "/control/rate?value=2.5").Code).To(Equal(http.StatusOK))
+		Expect(controller.Rate()).To(Equal(2.5))
+	})
+
+	It("Rejects invalid rates", func() {
+		Expect(request("POST", "/control/rate?value=fast").Code).To(Equal(http.StatusBadRequest))
+		Expect(request("POST", "/control/rate?value=-1").Code).To(Equal(http.StatusBadRequest))
+		Expect(request("POST", "/control/rate?value=0").Code).To(Equal(http.StatusBadRequest))
+		Expect(controller.Rate()).To(Equal(1.0))
+	})
+
+	It("Stops", func() {
+		Expect(request("POST", "/control/stop").Code).To(Equal(http.StatusOK))
+		Expect(controller.Stopped()).To(BeClosed())
+	})
+
+	It("Requires POST", func() {
+		Expect(request("GET", "/control/pause").Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("Follows a schedule until the rate is overridden", func() {
+		Expect(controller.SetScheduledRate(2)).To(Succeed())
+		Expect(controller.Rate()).To(Equal(2.0))
+
+		Expect(request("POST", "/control/rate?value=3").Code).To(Equal(http.StatusOK))
+
+		_, _, changed := controller.State()
+		Expect(controller.SetScheduledRate(4)).To(Succeed())
+		Expect(controller.Rate()).To(Equal(3.0))
+		Expect(changed).NotTo(BeClosed())
+	})
+
+	It("Never loses an override to a schedule changing the rate at the same time", func() {
+		for attempt := 0; attempt < 100; attempt++ {
+			controller := NewController()
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				for idx := 0; idx < 100; idx++ {
+					controller.SetScheduledRate(2)
+				}
+			}()
+
+			Expect(controller.OverrideRate(3)).To(Succeed())
+			<-done
+
+			Expect(controller.Rate()).To(Equal(3.0))
+		}
+	})
+
+	It("Rejects invalid scheduled rates", func() {
+		Expect(controller.SetScheduledRate(0)).NotTo(Succeed())
+		Expect(controller.Rate()).To(Equal(1.0))
+	})
+})
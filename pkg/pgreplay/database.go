@@ -2,11 +2,13 @@ package pgreplay
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
-	"github.com/eapache/channels"
 	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -36,8 +38,99 @@ var (
 			Help: "Most recent timestamp of processed items",
 		},
 	)
+	sessionThinkTimeSecondsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_session_think_time_seconds_total",
+			Help: "Time sessions have spent waiting to preserve their original think time",
+		},
+	)
+	itemsAbandonedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_items_abandoned_total",
+			Help: "Number of items left unprocessed because the replay was stopped or their connection died",
+		},
+	)
+	sessionsByState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_sessions",
+			Help: "Number of sessions in each state. Closed sessions are those whose connection ended before they logged their Disconnect.",
+		},
+		[]string{"state"},
+	)
+	connectDurationSeconds = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pgreplay_connect_duration_seconds",
+			Help:    "Time taken to establish each connection against Postgres",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+	connectFailuresTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_connect_failures_total",
+			Help: "Number of connections we failed to establish against Postgres",
+		},
+	)
+	connectRetriesTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_connect_retries_total",
+			Help: "Number of times we retried a failed connection attempt",
+		},
+	)
+	connectGiveUpsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_connect_give_ups_total",
+			Help: "Number of sessions whose items were dropped because we gave up connecting",
+		},
+	)
+	connectItemsDroppedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_connect_items_dropped_total",
+			Help: "Number of items dropped because we couldn't connect their session",
+		},
+	)
+	itemsSkippedAtDisconnectTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_items_skipped_at_disconnect_total",
+			Help: "Number of items skipped because their session disconnected before we executed them",
+		},
+	)
+)
+
+const (
+	// TimingGlobal executes each item as soon as the Streamer releases it, scheduling every
+	// item against the start of the replay. Sessions that fall behind will execute their
+	// remaining items back-to-back, as clients that don't wait for responses would.
+	TimingGlobal = "global"
+	// TimingSession additionally paces each item by its original gap from the session's
+	// previous item, measured from when that item finished. This preserves the think time
+	// of clients that wait for each response before sending their next statement.
+	TimingSession = "session"
+)
+
+// SessionState describes where a session's connection is in its lifecycle
+type SessionState string
+
+const (
+	SessionConnecting SessionState = "connecting"
+	SessionActive     SessionState = "active"
+	SessionClosed     SessionState = "closed"
+)
+
+// ErrSessionDisconnected is reported for items that were dropped because their session
+// had already disconnected by the time we reached them
+var ErrSessionDisconnected = errors.New("session disconnected before item was executed")
+
+// ErrReplayStopped and ErrConnectionLost are reported for items that were abandoned,
+// because the replay was stopped or the session's connection died before we reached them
+var (
+	ErrReplayStopped  = errors.New("replay stopped before item was executed")
+	ErrConnectionLost = errors.New("connection lost before item was executed")
 )
 
+// ShutdownTimeout bounds how long we'll wait for Postgres to acknowledge cancel requests
+// and connection terminations once the replay has been stopped.
+var ShutdownTimeout = 5 * time.Second
+
 func NewDatabase(ctx context.Context, cfg DatabaseConnConfig) (*Database, error) {
 	connConfig, err := pgx.ParseConfig(ParseConnData(cfg))
 	if err != nil {
@@ -49,7 +142,18 @@ func NewDatabase(ctx context.Context, cfg DatabaseConnConfig) (*Database, error)
 		return nil, err
 	}
 
-	return &Database{connConfig, map[SessionID]*Conn{}}, conn.Close(ctx)
+	return &Database{
+		cfg:      connConfig,
+		conns:    map[SessionID]*Conn{},
+		Observer: NopObserver{},
+		Timing:   TimingGlobal,
+		ordering: newOrderingBarrier(),
+		lag:      newLagTracker(),
+
+		TxRecovery:        TxRecoveryNone,
+		ConnectBackoff:    100 * time.Millisecond,
+		ConnectMaxBackoff: 5 * time.Second,
+	}, conn.Close(ctx)
 }
 
 func ParseConnData(cfg DatabaseConnConfig) string {
@@ -62,6 +166,67 @@ func ParseConnData(cfg DatabaseConnConfig) string {
 type Database struct {
 	cfg   *pgx.ConnConfig
 	conns map[SessionID]*Conn
+
+	// Observer is notified as items are dispatched and executed, and as connections open
+	// and close. It must be set before calling Consume.
+	Observer Observer
+	// Timing determines how each session paces its items, either TimingGlobal or
+	// TimingSession
+	Timing string
+	// Controller, if set, provides the replay rate used to scale session think time
+	Controller *Controller
+	// StrictOrdering holds back each item until every item with an earlier timestamp, in
+	// any session, has completed or we've waited for OrderingTimeout. A zero timeout
+	// waits indefinitely.
+	StrictOrdering  bool
+	OrderingTimeout time.Duration
+	// ConnectRetries is how many times we retry a failed connection attempt, waiting
+	// ConnectBackoff before the first retry and doubling the wait each time, up to
+	// ConnectMaxBackoff. We give up on a session once we're out of retries, or once we've
+	// spent ConnectGiveUpAfter trying, dropping every item sent to it. Zero durations
+	// impose no limit.
+	ConnectRetries     int
+	ConnectBackoff     time.Duration
+	ConnectMaxBackoff  time.Duration
+	ConnectGiveUpAfter time.Duration
+	// ConnectTimeout bounds each connection attempt, where zero waits indefinitely
+	ConnectTimeout time.Duration
+	// Queue bounds how many items each session may have waiting to execute, and decides
+	// what to do when a session falls so far behind that its queue is full
+	Queue QueuePolicy
+	// DisconnectOnSchedule closes each session once its Disconnect is dispatched, so that
+	// sessions end when they originally did, skipping any items they've yet to execute.
+	// Otherwise a session executes everything queued ahead of its Disconnect. It has no
+	// effect with TimingSession, which runs sessions behind schedule by design.
+	DisconnectOnSchedule bool
+	// MaxLag, if set, skips any item other than Connect and Disconnect that is more than
+	// this far behind its scheduled time when its session reaches it
+	MaxLag time.Duration
+	// StatementTimeout bounds how long each statement may run. Statements that exceed it
+	// are cancelled, and the session continues with its next item.
+	StatementTimeout StatementTimeout
+	// TxRecovery determines what we do with sessions stuck in an aborted transaction,
+	// either TxRecoveryNone or TxRecoveryRollback
+	TxRecovery string
+	// AbortTransactions skips the rest of a transaction once one of its statements fails,
+	// rolling it back in place of its COMMIT. Items must be grouped by GroupTransactions.
+	AbortTransactions bool
+
+	ordering *orderingBarrier
+	lag      *lagTracker
+	txStats  txRecoveryStats
+
+	// sendCancel asks Postgres to cancel whatever the connection is running, defaulting
+	// to a cancel request, and is replaced in tests
+	sendCancel func(context.Context, *pgconn.PgConn) error
+}
+
+func (d *Database) cancelRequest(ctx context.Context, conn *pgconn.PgConn) error {
+	if d.sendCancel != nil {
+		return d.sendCancel(ctx, conn)
+	}
+
+	return conn.CancelRequest(ctx)
 }
 
 // Consume iterates through all the items in the given channel and attempts to process
@@ -75,44 +240,105 @@ func (d *Database) Consume(ctx context.Context, items chan Item) (chan error, ch
 
 	errs, done := make(chan error, 10), make(chan error)
 
+	// failure is the first error that ended a session early, which we report to our
+	// Observer as the reason the replay didn't finish cleanly
+	var failure error
+	var failureOnce sync.Once
+	fail := func(err error) {
+		failureOnce.Do(func() { failure = err })
+		errs <- err
+	}
+
 	go func() {
 		for item := range items {
-			var err error
+			if d.StrictOrdering {
+				d.ordering.Wait(ctx, item, d.OrderingTimeout)
+			}
+
 			conn, ok := d.conns[item.GetSessionID()]
 
-			// Connection did not exist, so create a new one
+			// Connection did not exist, so create a new one. The Streamer releases each item
+			// at its scheduled time, so sessions are connected when their Connect item was
+			// logged, reproducing any storm of connections. Sessions that connected before
+			// the start of our logs have no Connect, and are connected at their first item.
+			//
+			// We connect in the session's own goroutine, so a slow connection only holds up
+			// its own session. Items dispatched in the meantime wait in the session's queue.
 			if !ok {
-				if conn, err = d.Connect(ctx, item); err != nil {
-					errs <- err
+				// There's no point connecting a session only to disconnect it
+				switch item.(type) {
+				case Disconnect, *Disconnect:
 					continue
 				}
 
+				conn = d.newConn()
 				d.conns[item.GetSessionID()] = conn
 
 				wg.Add(1)
-				connectionsEstablishedTotal.Inc()
-				connectionsActive.Inc()
-
-				go func(conn *Conn) {
+				go func(item Item, conn *Conn) {
 					defer wg.Done()
+
+					if err := conn.connect(ctx, item); err != nil {
+						fail(err)
+						conn.drop(err)
+						return
+					}
+
+					connectionsEstablishedTotal.Inc()
+					connectionsActive.Inc()
+					d.Observer.ConnOpened(item.GetSessionID())
+
 					defer connectionsActive.Dec()
+					defer d.Observer.ConnClosed(item.GetSessionID())
 
 					if err := conn.Start(ctx); err != nil {
-						errs <- err
+						fail(err)
 					}
-				}(conn)
+				}(item, conn)
 			}
 
-			conn.In() <- item
+			if d.StrictOrdering {
+				d.ordering.Add(item)
+			}
+
+			d.Observer.ItemDispatched(item)
+			conn.queue.Push(item)
+
+			// A Disconnect is the last item of its session, so we can close the session's
+			// queue and forget about it. If the session ID is reused, its items will go to a
+			// fresh connection.
+			switch item.(type) {
+			case Disconnect, *Disconnect:
+				// If asked to close sessions when they did originally, tell the connection to
+				// skip anything it hasn't yet got to. Session timing deliberately runs
+				// sessions behind schedule, so there we let the session reach its Disconnect
+				// in its own time.
+				if d.DisconnectOnSchedule && d.Timing == TimingGlobal {
+					conn.disconnect()
+				}
+
+				conn.Close()
+				conn.forget()
+				delete(d.conns, item.GetSessionID())
+			}
 		}
 
-		for _, conn := range d.conns {
+		for sessionID, conn := range d.conns {
 			conn.Close()
+			conn.forget()
+			delete(d.conns, sessionID)
 		}
 
 		// Wait for every connection to terminate
 		wg.Wait()
 
+		// Being stopped explains any failures it caused, so takes precedence over them
+		if err := ctx.Err(); err != nil {
+			failure = err
+		}
+
+		d.Observer.ReplayFinished(failure)
+
 		close(errs)
 		close(done)
 	}()
@@ -120,51 +346,285 @@ func (d *Database) Consume(ctx context.Context, items chan Item) (chan error, ch
 	return errs, done
 }
 
-// Connect establishes a new connection to the database, reusing the ConnInfo that was
-// generated when the Database was constructed. The wg is incremented whenever we
-// establish a new connection and decremented when we disconnect.
-func (d *Database) Connect(ctx context.Context, item Item) (*Conn, error) {
+// OrderingStall reports how long strict ordering has held back items, and how many times
+// we gave up waiting for earlier items to complete.
+func (d *Database) OrderingStall() (time.Duration, int) {
+	return d.ordering.Stall()
+}
+
+// TxRecoveryReport reports how many statements we saved, and lost, by rolling back aborted
+// transactions
+func (d *Database) TxRecoveryReport() TxRecoveryReport {
+	return d.txStats.Report()
+}
+
+// LagSkips reports the items we skipped for falling further behind schedule than MaxLag
+func (d *Database) LagSkips() LagReport {
+	return d.lag.Report()
+}
+
+// complete marks an item as finished, releasing anything held back behind it
+func (d *Database) complete(item Item) {
+	if d.StrictOrdering {
+		d.ordering.Done(item)
+	}
+}
+
+// Connect makes a single attempt to connect as the item's user to its database, reusing
+// the ConnInfo that was generated when the Database was constructed.
+func (d *Database) Connect(ctx context.Context, item Item) (*pgx.Conn, error) {
 	cfg := d.cfg.Copy()
 	cfg.Database, cfg.User = item.GetDatabase(), item.GetUser()
 
+	if d.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.ConnectTimeout)
+		defer cancel()
+	}
+
+	started := time.Now()
 	conn, err := pgx.Connect(ctx, cfg.ConnString())
 	if err != nil {
+		connectFailuresTotal.Inc()
 		return nil, err
 	}
 
-	return &Conn{conn, channels.NewInfiniteChannel(), sync.Once{}}, nil
+	connectDurationSeconds.Observe(time.Since(started).Seconds())
+
+	return conn, nil
+}
+
+// newConn creates a Conn that queues items until it has connected
+func (d *Database) newConn() *Conn {
+	conn := &Conn{
+		db:            d,
+		disconnecting: make(chan struct{}),
+	}
+
+	conn.queue = newSessionQueue(d.Queue, func(item Item) {
+		d.Observer.ItemDropped(item, ErrQueueOverflow)
+		d.complete(item)
+	})
+
+	conn.setState(SessionConnecting)
+
+	return conn
 }
 
 // Conn represents a single database connection handling a stream of work Items
 type Conn struct {
 	*pgx.Conn
-	channels.Channel
-	sync.Once
+
+	db    *Database
+	queue *sessionQueue
+
+	disconnecting  chan struct{}
+	disconnectOnce sync.Once
+
+	tx     txState
+	lagged bool // whether we've skipped any item for being behind schedule
+
+	mu        sync.Mutex
+	state     SessionState
+	forgotten bool // no longer tracked by the Database
+}
+
+// State reports where our session is in its lifecycle
+func (c *Conn) State() SessionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
 }
 
+func (c *Conn) setState(state SessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != "" && !c.forgotten {
+		sessionsByState.WithLabelValues(string(c.state)).Dec()
+	}
+
+	c.state = state
+
+	if !c.forgotten {
+		sessionsByState.WithLabelValues(string(c.state)).Inc()
+	}
+}
+
+// forget stops counting our session once the Database no longer tracks it. Sessions that
+// are still connecting or active continue to be counted until they close.
+func (c *Conn) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == SessionClosed {
+		sessionsByState.WithLabelValues(string(c.state)).Dec()
+	}
+
+	c.forgotten = true
+}
+
+// Close stops our queue from accepting more items. We'll finish once we've dealt with
+// everything already in it.
 func (c *Conn) Close() {
-	c.Once.Do(c.Channel.Close)
+	c.queue.Close()
+}
+
+// connect establishes our connection for the session of the given item, retrying with
+// backoff until we succeed or our Database's retry policy tells us to give up.
+func (c *Conn) connect(ctx context.Context, item Item) error {
+	started, backoff := time.Now(), c.db.ConnectBackoff
+
+	for attempt := 0; ; attempt++ {
+		conn, err := c.db.Connect(ctx, item)
+		if err == nil {
+			c.Conn = conn
+			c.setState(SessionActive)
+			return nil
+		}
+
+		if ctx.Err() != nil || attempt >= c.db.ConnectRetries {
+			connectGiveUpsTotal.Inc()
+			return fmt.Errorf("gave up connecting session %s after %d attempts: %w", item.GetSessionID(), attempt+1, err)
+		}
+
+		if c.db.ConnectGiveUpAfter > 0 && time.Since(started)+backoff > c.db.ConnectGiveUpAfter {
+			connectGiveUpsTotal.Inc()
+			return fmt.Errorf("gave up connecting session %s after %s: %w", item.GetSessionID(), time.Since(started), err)
+		}
+
+		connectRetriesTotal.Inc()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; c.db.ConnectMaxBackoff > 0 && backoff > c.db.ConnectMaxBackoff {
+			backoff = c.db.ConnectMaxBackoff
+		}
+	}
 }
 
-// Start begins to process the items that are placed into the Conn's channel. We'll finish
-// once the connection has died or we run out of items to process.
+// drop discards every item sent to a session we failed to connect, reporting each of
+// them, until the Database closes our queue.
+func (c *Conn) drop(reason error) {
+	c.setState(SessionClosed)
+
+	for {
+		item, _, ok := c.queue.Pop()
+		if !ok {
+			return
+		}
+
+		connectItemsDroppedTotal.Inc()
+		c.db.Observer.ItemDropped(item, reason)
+		c.db.complete(item)
+	}
+}
+
+// disconnect signals that our session's Disconnect is due, so we should skip any items
+// we haven't yet executed and close the connection
+func (c *Conn) disconnect() {
+	c.disconnectOnce.Do(func() { close(c.disconnecting) })
+}
+
+func (c *Conn) disconnected() bool {
+	select {
+	case <-c.disconnecting:
+		return true
+	default:
+		return false
+	}
+}
+
+// Start begins to process the items that are placed into the Conn's queue. We'll finish
+// once the Database has closed our queue and we've dealt with every item in it. If our
+// connection dies first, the remaining items are abandoned.
+//
+// If the context is cancelled then any in-flight statement is cancelled, and we skip all
+// remaining items before closing the connection cleanly.
 func (c *Conn) Start(ctx context.Context) error {
-	items := make(chan Item)
-	channels.Unwrap(c.Channel, items)
-	defer c.Close()
+	defer c.setState(SessionClosed)
+
+	// Track our previous item so we can preserve think time, if required
+	var lastTimestamp, lastFinished time.Time
+
+	for {
+		item, due, ok := c.queue.Pop()
+		if !ok {
+			break
+		}
+
+		if c.db.Timing == TimingSession && !lastFinished.IsZero() {
+			c.pace(ctx, lastFinished, item.GetTimestamp().Sub(lastTimestamp))
+		}
+
+		// Once we've been told to stop, we drain the queue without executing anything
+		if ctx.Err() != nil {
+			itemsAbandonedTotal.Inc()
+			c.db.Observer.ItemDropped(item, ErrReplayStopped)
+			c.db.complete(item)
+			continue
+		}
+
+		// Our session has already disconnected, so anything still queued ahead of the
+		// Disconnect is too late to execute. We never interrupt an in-flight statement.
+		if c.disconnected() {
+			switch item.(type) {
+			case Disconnect, *Disconnect:
+			default:
+				itemsSkippedAtDisconnectTotal.Inc()
+				c.db.Observer.ItemDropped(item, ErrSessionDisconnected)
+				c.db.complete(item)
+				continue
+			}
+		}
+
+		// If we've fallen too far behind the time the Streamer scheduled the item for,
+		// whether held up before or after reaching our queue, the item is no longer
+		// representative. Items that didn't come from a Streamer are measured from when
+		// they were queued.
+		scheduled := scheduledAt(item)
+		if scheduled.IsZero() {
+			scheduled = due
+		}
+
+		if c.db.lag.Skip(item, scheduled, c.db.MaxLag, c.lagged) {
+			c.lagged = true
+			c.db.Observer.ItemDropped(item, ErrBehindSchedule)
+			c.db.complete(item)
+			continue
+		}
 
-	for item := range items {
-		if item == nil {
+		item, ok = c.abortTransaction(item)
+		if !ok {
+			c.db.Observer.ItemDropped(item, ErrTransactionAborted)
+			c.db.complete(item)
 			continue
 		}
 
 		itemsProcessedTotal.Inc()
 		itemsMostRecentTimestamp.Set(float64(item.GetTimestamp().Unix()))
 
-		err := item.Handle(ctx, c.Conn)
+		c.recoverTx(ctx, item)
+
+		c.db.Observer.ExecStarted(item)
+		started := time.Now()
+		tag, err := c.handle(ctx, item)
+		c.db.Observer.ExecFinished(item, time.Since(started), tag, err)
+
+		c.trackTx(item, err)
+		c.failTransaction(ctx, item, err)
+
+		lastTimestamp, lastFinished = item.GetTimestamp(), time.Now()
+		c.db.complete(item)
 
 		// If we're no longer alive, then we know we can no longer process items
 		if c.IsClosed() {
+			c.setState(SessionClosed)
+			c.abandon(ctx)
 			return err
 		}
 	}
@@ -174,8 +634,115 @@ func (c *Conn) Start(ctx context.Context) error {
 	// terminate ourselves by handling our own disconnect, so we can know when all our
 	// connection are done.
 	if !c.IsClosed() {
-		Disconnect{}.Handle(ctx, c.Conn)
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ShutdownTimeout)
+		defer cancel()
+
+		Disconnect{}.Handle(closeCtx, c.Conn)
 	}
 
 	return nil
 }
+
+// abandon discards anything sent to us until the Database closes our queue, completing
+// each item so that nothing waits on them.
+func (c *Conn) abandon(ctx context.Context) {
+	reason := ErrConnectionLost
+	if ctx.Err() != nil {
+		reason = ErrReplayStopped
+	}
+
+	for {
+		item, _, ok := c.queue.Pop()
+		if !ok {
+			return
+		}
+
+		itemsAbandonedTotal.Inc()
+		c.db.Observer.ItemDropped(item, reason)
+		c.db.complete(item)
+	}
+}
+
+// pace waits out the think time the session originally spent between finishing its
+// previous item and starting this one, counting from when we finished our previous item.
+// Like the Streamer, we follow the Controller: pausing stops the clock, and a change of
+// rate applies to whatever think time remains. We return early if our context is
+// cancelled.
+func (c *Conn) pace(ctx context.Context, lastFinished time.Time, think time.Duration) {
+	rate, paused, changed := 1.0, false, (<-chan struct{})(nil)
+	if c.db.Controller != nil {
+		rate, paused, changed = c.db.Controller.State()
+	}
+
+	// remaining is how much of the logged think time we've yet to wait, as of anchor
+	remaining, anchor := think, lastFinished
+
+	started := time.Now()
+	defer func() {
+		sessionThinkTimeSecondsTotal.Add(time.Since(started).Seconds())
+	}()
+
+	for {
+		var wait <-chan time.Time
+		if !paused {
+			diff := time.Duration(float64(remaining)/rate) - time.Since(anchor)
+			if diff <= 0 {
+				return
+			}
+
+			wait = time.After(diff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wait:
+			return
+		case <-changed:
+			now := time.Now()
+			if !paused {
+				remaining -= time.Duration(float64(now.Sub(anchor)) * rate)
+			}
+
+			anchor = now
+			rate, paused, changed = c.db.Controller.State()
+		}
+	}
+}
+
+// handle executes the item against our connection. pgx responds to context cancellation
+// by closing the underlying socket, which would abandon the session mid-statement. We
+// instead hide cancellation from pgx and send Postgres a cancel request, which aborts the
+// statement but leaves the connection usable so we can close it cleanly, or continue
+// with our next item if the statement only exceeded its timeout.
+func (c *Conn) handle(ctx context.Context, item Item) (pgconn.CommandTag, error) {
+	execCtx := ctx
+	if timeout := c.db.StatementTimeout.For(item); timeout > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// If the cancel request has already started, we must wait for it to be sent before
+	// returning, as otherwise it could arrive while we're executing our next item
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(execCtx, func() {
+		defer close(cancelled)
+
+		cancelCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+
+		c.db.cancelRequest(cancelCtx, c.PgConn())
+	})
+
+	tag, err := item.Handle(context.WithoutCancel(ctx), c.Conn)
+	if err != nil && ctx.Err() == nil && execCtx.Err() == context.DeadlineExceeded {
+		statementTimeoutsTotal.Inc()
+	}
+
+	if !stop() {
+		<-cancelled
+	}
+
+	return tag, err
+}
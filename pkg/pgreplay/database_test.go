@@ -0,0 +1,642 @@
+package pgreplay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakePostgres speaks just enough of the Postgres protocol for a Database to connect and
+// run simple queries, so that we can test connections without a real server. Queries of
+// the form "select pg_sleep(N)" run for N seconds, unless cancelled first, and "select
+// 1/0" fails. As in Postgres, a failure inside a transaction aborts it, and every query
+// but the end of the transaction fails until then.
+type fakePostgres struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	pid        uint32
+	running    map[uint32]chan struct{} // closed to cancel the query each backend is running
+	queries    []string
+	cancelled  []string
+	terminated int
+}
+
+func newFakePostgres() *fakePostgres {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	server := &fakePostgres{listener: listener, running: map[uint32]chan struct{}{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (f *fakePostgres) Close() {
+	f.listener.Close()
+}
+
+// Database returns a Database that connects to us
+func (f *fakePostgres) Database() *Database {
+	cfg, err := pgx.ParseConfig(fmt.Sprintf("postgres://postgres@%s/postgres?sslmode=disable", f.listener.Addr()))
+	Expect(err).NotTo(HaveOccurred())
+
+	return &Database{
+		cfg:      cfg,
+		conns:    map[SessionID]*Conn{},
+		Observer: NopObserver{},
+		Timing:   TimingGlobal,
+		ordering: newOrderingBarrier(),
+		lag:      newLagTracker(),
+	}
+}
+
+// Queries returns every query we've received, in order
+func (f *fakePostgres) Queries() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string{}, f.queries...)
+}
+
+// Cancelled returns every query that was cancelled, in order
+func (f *fakePostgres) Cancelled() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string{}, f.cancelled...)
+}
+
+// Terminated counts the connections that were closed cleanly
+func (f *fakePostgres) Terminated() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.terminated
+}
+
+// Cancel cancels whatever query the backend is running, as a cancel request would. As in
+// Postgres, a backend that isn't running anything ignores the cancellation.
+func (f *fakePostgres) Cancel(pid uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cancel, ok := f.running[pid]; ok {
+		close(cancel)
+		delete(f.running, pid)
+	}
+}
+
+func (f *fakePostgres) serve(conn net.Conn) {
+	defer conn.Close()
+
+	backend := pgproto3.NewBackend(conn, conn)
+	startup, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+
+	switch startup := startup.(type) {
+	case *pgproto3.CancelRequest:
+		f.Cancel(startup.ProcessID)
+		return
+	case *pgproto3.StartupMessage:
+	default:
+		return
+	}
+
+	f.mu.Lock()
+	f.pid++
+	pid := f.pid
+	f.mu.Unlock()
+
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: pid, SecretKey: pid})
+	status := byte(txStatusIdle)
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			var failure *pgproto3.ErrorResponse
+			if status, failure = f.execute(pid, status, msg.String); failure != nil {
+				backend.Send(failure)
+			} else {
+				backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+			}
+
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+			if err := backend.Flush(); err != nil {
+				return
+			}
+		case *pgproto3.Terminate:
+			f.mu.Lock()
+			f.terminated++
+			f.mu.Unlock()
+
+			return
+		}
+	}
+}
+
+// execute runs the query in a backend whose transaction has the given status, returning
+// the status that follows
+func (f *fakePostgres) execute(pid uint32, status byte, query string) (byte, *pgproto3.ErrorResponse) {
+	var ends bool
+	switch strings.ToLower(query) {
+	case "commit", "end", "rollback", "abort":
+		ends = true
+	}
+
+	if status == txStatusFailed && !ends {
+		f.mu.Lock()
+		f.queries = append(f.queries, query)
+		f.mu.Unlock()
+
+		return status, &pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     "25P02",
+			Message:  "current transaction is aborted, commands ignored until end of transaction block",
+		}
+	}
+
+	var failure *pgproto3.ErrorResponse
+	if err := f.query(pid, query); err != nil {
+		failure = &pgproto3.ErrorResponse{Severity: "ERROR", Code: "57014", Message: err.Error()}
+	} else if query == "select 1/0" {
+		failure = &pgproto3.ErrorResponse{Severity: "ERROR", Code: "22012", Message: "division by zero"}
+	}
+
+	switch {
+	case failure != nil && status == txStatusActive:
+		return txStatusFailed, failure
+	case failure != nil:
+		return status, failure
+	case ends:
+		return txStatusIdle, nil
+	case strings.ToLower(query) == "begin":
+		return txStatusActive, nil
+	}
+
+	return status, nil
+}
+
+func (f *fakePostgres) query(pid uint32, query string) error {
+	cancel := make(chan struct{})
+
+	f.mu.Lock()
+	f.queries = append(f.queries, query)
+	f.running[pid] = cancel
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.running[pid] == cancel {
+			delete(f.running, pid)
+		}
+	}()
+
+	var seconds float64
+	if _, err := fmt.Sscanf(query, "select pg_sleep(%g)", &seconds); err != nil {
+		return nil
+	}
+
+	select {
+	case <-time.After(time.Duration(seconds * float64(time.Second))):
+		return nil
+	case <-cancel:
+		f.mu.Lock()
+		f.cancelled = append(f.cancelled, query)
+		f.mu.Unlock()
+
+		return errors.New("canceling statement due to user request")
+	}
+}
+
+// droppedObserver records every item the Database drops
+type droppedObserver struct {
+	NopObserver
+
+	mu      sync.Mutex
+	dropped []Item
+}
+
+func (o *droppedObserver) ItemDropped(item Item, _ error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.dropped = append(o.dropped, item)
+}
+
+var _ = Describe("Database", func() {
+	var (
+		database *Database
+		observer *droppedObserver
+	)
+
+	BeforeEach(func() {
+		// Nothing listens on port 1, so every connection attempt is refused
+		cfg, err := pgx.ParseConfig("postgres://postgres@127.0.0.1:1/postgres")
+		Expect(err).NotTo(HaveOccurred())
+
+		observer = &droppedObserver{}
+		database = &Database{
+			cfg:            cfg,
+			conns:          map[SessionID]*Conn{},
+			Observer:       observer,
+			Timing:         TimingGlobal,
+			ordering:       newOrderingBarrier(),
+			lag:            newLagTracker(),
+			ConnectRetries: 2,
+		}
+	})
+
+	It("Drops and reports every item of a session it gives up connecting", func() {
+		details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+		items := make(chan Item, 3)
+		items <- Connect{details}
+		items <- Statement{details, "select 1"}
+		items <- Disconnect{details}
+		close(items)
+
+		errs, done := database.Consume(context.Background(), items)
+
+		var reported []error
+		for err := range errs {
+			reported = append(reported, err)
+		}
+
+		Eventually(done).Should(BeClosed())
+		Expect(reported).To(HaveLen(1))
+		Expect(reported[0].Error()).To(ContainSubstring("gave up connecting session a after 3 attempts"))
+		Expect(observer.dropped).To(HaveLen(3))
+	})
+
+	It("Starts a fresh connection when a session ID is reused after disconnecting", func() {
+		details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+		items := make(chan Item, 4)
+		items <- Disconnect{details}
+		items <- Connect{details}
+		items <- Disconnect{details}
+		items <- Statement{details, "select 1"}
+		close(items)
+
+		database.ConnectRetries = 0
+		errs, _ := database.Consume(context.Background(), items)
+
+		var reported []error
+		for err := range errs {
+			reported = append(reported, err)
+		}
+
+		// The leading Disconnect has no session to close, then each of the remaining
+		// sessions tries, and fails, to connect
+		Expect(reported).To(HaveLen(2))
+		Expect(observer.dropped).To(HaveLen(3))
+		Expect(database.conns).To(BeEmpty())
+	})
+
+	Context("When a session falls behind its Disconnect", func() {
+		var (
+			server   *fakePostgres
+			recorder *recordingObserver
+		)
+
+		BeforeEach(func() {
+			server = newFakePostgres()
+			recorder = &recordingObserver{}
+			database = server.Database()
+			database.Observer = recorder
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		// replay dispatches the session's Disconnect while it is still executing the slow
+		// statement ahead of it
+		replay := func() {
+			details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+			items := make(chan Item)
+			go func() {
+				defer GinkgoRecover()
+				defer close(items)
+
+				items <- Connect{details}
+				items <- Statement{details, "select pg_sleep(0.2)"}
+				items <- Statement{details, "select 1"}
+
+				Eventually(server.Queries).Should(HaveLen(1))
+				items <- Disconnect{details}
+			}()
+
+			errs, done := database.Consume(context.Background(), items)
+			for range errs {
+				// no-op, we check what the server received
+			}
+
+			Eventually(done).Should(BeClosed())
+			Eventually(server.Terminated).Should(Equal(1))
+		}
+
+		It("Executes everything queued ahead of the Disconnect by default", func() {
+			replay()
+
+			Expect(server.Queries()).To(Equal([]string{"select pg_sleep(0.2)", "select 1"}))
+			Expect(recorder.Events("ItemDropped")).To(BeEmpty())
+		})
+
+		It("Skips what it hasn't reached when disconnecting on schedule", func() {
+			database.DisconnectOnSchedule = true
+			replay()
+
+			Expect(server.Queries()).To(Equal([]string{"select pg_sleep(0.2)"}))
+			Expect(recorder.Events("ItemDropped")).To(Equal([]string{
+				"ItemDropped a(select 1) " + ErrSessionDisconnected.Error(),
+			}))
+		})
+
+		It("Ignores the schedule with session timing", func() {
+			database.DisconnectOnSchedule = true
+			database.Timing = TimingSession
+			replay()
+
+			Expect(server.Queries()).To(Equal([]string{"select pg_sleep(0.2)", "select 1"}))
+		})
+	})
+
+	Context("When items fall behind schedule", func() {
+		var (
+			server   *fakePostgres
+			recorder *recordingObserver
+		)
+
+		BeforeEach(func() {
+			server = newFakePostgres()
+			recorder = &recordingObserver{}
+			database = server.Database()
+			database.Observer = recorder
+			database.MaxLag = time.Second
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Measures lag from when the Streamer scheduled them, not when they were queued", func() {
+			details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+			schedule := func(item Item, scheduled time.Time) Item {
+				return mapDetails(item, func(details Details) Details {
+					details.scheduled = scheduled
+					return details
+				})
+			}
+
+			// Both items are queued immediately, but the first was scheduled long ago and
+			// held up before it reached us
+			items := make(chan Item, 3)
+			items <- schedule(Connect{details}, time.Now().Add(-time.Minute))
+			items <- schedule(Statement{details, "select 1"}, time.Now().Add(-time.Minute))
+			items <- schedule(Statement{details, "select 2"}, time.Now())
+			close(items)
+
+			errs, done := database.Consume(context.Background(), items)
+			for range errs {
+				// no-op, we check what the server received
+			}
+
+			Eventually(done).Should(BeClosed())
+
+			Expect(server.Queries()).To(Equal([]string{"select 2"}))
+			Expect(recorder.Events("ItemDropped")).To(Equal([]string{
+				"ItemDropped a(select 1) " + ErrBehindSchedule.Error(),
+			}))
+			Expect(database.LagSkips().Sessions).To(Equal(1))
+		})
+	})
+
+	Context("When statements time out", func() {
+		var (
+			server   *fakePostgres
+			recorder *recordingObserver
+			details  = Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+		)
+
+		BeforeEach(func() {
+			server = newFakePostgres()
+			recorder = &recordingObserver{}
+			database = server.Database()
+			database.Observer = recorder
+			database.StatementTimeout = StatementTimeout{Absolute: 50 * time.Millisecond}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		replay := func(queries ...string) {
+			items := make(chan Item, len(queries)+1)
+			items <- Connect{details}
+			for _, query := range queries {
+				items <- Statement{details, query}
+			}
+			close(items)
+
+			errs, done := database.Consume(context.Background(), items)
+			for range errs {
+				// no-op, we check what the server received
+			}
+
+			Eventually(done).Should(BeClosed())
+		}
+
+		It("Cancels the statement and continues with the next on the same connection", func() {
+			replay("select pg_sleep(10)", "select pg_sleep(0.01)")
+
+			Expect(server.Cancelled()).To(Equal([]string{"select pg_sleep(10)"}))
+			Expect(recorder.Events("ExecFinished a(select")).To(Equal([]string{
+				"ExecFinished a(select pg_sleep(10)) ERROR: canceling statement due to user request (SQLSTATE 57014)",
+				"ExecFinished a(select pg_sleep(0.01)) <nil>",
+			}))
+		})
+
+		It("Never lets a late cancel request reach the next statement", func() {
+			// The first statement finishes after its timeout has fired, but before the
+			// cancel request reaches Postgres. Were we to move on without waiting for the
+			// request, it would cancel the second statement instead.
+			database.sendCancel = func(_ context.Context, conn *pgconn.PgConn) error {
+				time.Sleep(150 * time.Millisecond)
+				server.Cancel(conn.PID())
+
+				return nil
+			}
+
+			replay("select pg_sleep(0.1)", "select pg_sleep(0.2)")
+
+			Expect(server.Queries()).To(Equal([]string{"select pg_sleep(0.1)", "select pg_sleep(0.2)"}))
+			Expect(server.Cancelled()).To(BeEmpty())
+		})
+	})
+
+	Context("When pacing session think time", func() {
+		var (
+			controller *Controller
+			conn       *Conn
+		)
+
+		BeforeEach(func() {
+			controller = NewController()
+			conn = &Conn{db: &Database{Controller: controller}}
+		})
+
+		// paced measures how long we wait out the given think time from now
+		paced := func(ctx context.Context, think time.Duration) time.Duration {
+			started := time.Now()
+			conn.pace(ctx, started, think)
+
+			return time.Since(started)
+		}
+
+		It("Waits out the think time at the replay rate", func() {
+			Expect(controller.SetRate(2)).To(Succeed())
+			Expect(paced(context.Background(), 200*time.Millisecond)).To(
+				BeNumerically("~", 100*time.Millisecond, 40*time.Millisecond),
+			)
+		})
+
+		It("Waits at the original speed without a Controller", func() {
+			conn.db.Controller = nil
+			Expect(paced(context.Background(), 100*time.Millisecond)).To(
+				BeNumerically("~", 100*time.Millisecond, 40*time.Millisecond),
+			)
+		})
+
+		It("Doesn't wait once the think time has already passed", func() {
+			started := time.Now()
+			conn.pace(context.Background(), started.Add(-time.Second), 100*time.Millisecond)
+
+			Expect(time.Since(started)).To(BeNumerically("<", 20*time.Millisecond))
+		})
+
+		It("Stops the clock while paused", func() {
+			time.AfterFunc(50*time.Millisecond, controller.Pause)
+			time.AfterFunc(150*time.Millisecond, controller.Resume)
+
+			// 50ms before pausing, and the remaining 50ms after resuming
+			Expect(paced(context.Background(), 100*time.Millisecond)).To(
+				BeNumerically("~", 200*time.Millisecond, 40*time.Millisecond),
+			)
+		})
+
+		It("Applies a change of rate to the remaining think time", func() {
+			time.AfterFunc(50*time.Millisecond, func() { controller.SetRate(3) })
+
+			// 50ms at 1x leaves 150ms of think time, which takes 50ms at 3x
+			Expect(paced(context.Background(), 200*time.Millisecond)).To(
+				BeNumerically("~", 100*time.Millisecond, 40*time.Millisecond),
+			)
+		})
+
+		It("Returns once cancelled, even while paused", func() {
+			controller.Pause()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			Expect(paced(ctx, time.Hour)).To(
+				BeNumerically("~", 50*time.Millisecond, 40*time.Millisecond),
+			)
+		})
+	})
+
+	Context("When the replay is stopped", func() {
+		var server *fakePostgres
+
+		BeforeEach(func() {
+			server = newFakePostgres()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Cancels the running statement, abandons the rest and disconnects cleanly", func() {
+			details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+			logged := []Item{
+				Connect{details},
+				Statement{details, "select pg_sleep(10)"},
+				Statement{details, "select 1"},
+				Statement{details, "select 2"},
+			}
+
+			items := make(chan Item, len(logged))
+			for _, item := range logged {
+				items <- item
+			}
+			close(items)
+
+			summary := NewSummary()
+			database = server.Database()
+			database.Observer = MultiObserver{summary, observer}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			started := time.Now()
+			errs, done := database.Consume(ctx, items)
+			for range errs {
+				// no-op, we only care that the replay finishes
+			}
+
+			Eventually(done).Should(BeClosed())
+			Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+
+			Expect(server.Queries()).To(Equal([]string{"select pg_sleep(10)"}))
+			Expect(server.Cancelled()).To(Equal([]string{"select pg_sleep(10)"}))
+			Eventually(server.Terminated).Should(Equal(1))
+
+			Expect(observer.dropped).To(Equal(logged[2:]))
+			Expect(summaryLog(summary)).To(And(
+				HaveKeyWithValue("items_dispatched", int64(4)),
+				HaveKeyWithValue("items_executed", int64(2)),
+				HaveKeyWithValue("items_errored", int64(1)),
+				HaveKeyWithValue("items_dropped", int64(0)),
+				HaveKeyWithValue("items_abandoned", int64(2)),
+			))
+		})
+	})
+})
@@ -0,0 +1,283 @@
+package pgreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted files begin with a header of EncryptionMagic, a random salt and a value that
+// lets us check the key, followed by a stream of chunks. Each chunk seals up to
+// EncryptionChunkSize bytes of plaintext with AES-256-GCM, under a key derived from the
+// salt, and a nonce made from the chunk's position and whether it is the last chunk.
+// Chunks can't be reordered, dropped or appended without failing to open, and a file
+// that doesn't end with a last chunk must have been truncated.
+//
+// The header is authenticated as the additional data of every chunk.
+const (
+	EncryptionMagic     = "PGRPENC1"
+	EncryptionChunkSize = 64 * 1024
+
+	encryptionSaltSize  = 32
+	encryptionCheckSize = 32
+	encryptionHeaderLen = len(EncryptionMagic) + encryptionSaltSize + encryptionCheckSize
+)
+
+var (
+	// ErrEncryptionKey is returned when a file was encrypted with a different key
+	ErrEncryptionKey = errors.New("wrong encryption key")
+	// ErrEncryptedCorrupt is returned when an encrypted file has been truncated or
+	// tampered with
+	ErrEncryptedCorrupt = errors.New("encrypted file is truncated or has been tampered with")
+)
+
+// IsEncrypted reports whether the header belongs to an encrypted file
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(EncryptionMagic))
+}
+
+// ParseEncryptionKey decodes a key read from a file or the environment, trimming any
+// trailing newline. Short keys are rejected.
+func ParseEncryptionKey(key string) ([]byte, error) {
+	return parseKey(key)
+}
+
+type encryptionStream struct {
+	aead   cipher.AEAD
+	header []byte
+	chunk  uint64
+}
+
+// newEncryptionStream derives the key for a file from its salt, returning the stream
+// along with the value that proves we derived the right key
+func newEncryptionStream(key, salt []byte) (*encryptionStream, []byte, error) {
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("pgreplay encryption key"))
+	derive.Write(salt)
+	fileKey := derive.Sum(nil)
+
+	check := hmac.New(sha256.New, fileKey)
+	check.Write([]byte("pgreplay encryption check"))
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &encryptionStream{aead: aead}, check.Sum(nil), nil
+}
+
+func (s *encryptionStream) nonce(last bool) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], s.chunk)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// EncryptWriter encrypts everything written to it. It must be closed to write the final
+// chunk, without which the file can't be read.
+type EncryptWriter struct {
+	w      io.Writer
+	stream *encryptionStream
+	buffer []byte
+	err    error
+}
+
+// NewEncryptWriter writes the header of an encrypted file to w, returning a writer that
+// encrypts into it
+func NewEncryptWriter(w io.Writer, key []byte) (*EncryptWriter, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	stream, check, err := newEncryptionStream(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	stream.header = append(append([]byte(EncryptionMagic), salt...), check...)
+	if _, err := w.Write(stream.header); err != nil {
+		return nil, err
+	}
+
+	return &EncryptWriter{w: w, stream: stream, buffer: make([]byte, 0, EncryptionChunkSize)}, nil
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// We only seal a full chunk once we know more data follows it, as we won't know
+		// which chunk is last until we're closed
+		if len(e.buffer) == EncryptionChunkSize {
+			if e.err = e.seal(false); e.err != nil {
+				return written, e.err
+			}
+		}
+
+		n := copy(e.buffer[len(e.buffer):EncryptionChunkSize], p)
+		e.buffer = e.buffer[:len(e.buffer)+n]
+		p, written = p[n:], written+n
+	}
+
+	return written, nil
+}
+
+// Close writes the final chunk. It doesn't close the underlying writer.
+func (e *EncryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+
+	e.err = e.seal(true)
+	if e.err == nil {
+		e.err = errors.New("encrypt writer is closed")
+		return nil
+	}
+
+	return e.err
+}
+
+func (e *EncryptWriter) seal(last bool) error {
+	sealed := e.stream.aead.Seal(nil, e.stream.nonce(last), e.buffer, e.stream.header)
+	e.stream.chunk++
+	e.buffer = e.buffer[:0]
+
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// DecryptReader decrypts a file written by EncryptWriter, failing with
+// ErrEncryptedCorrupt if it has been truncated or tampered with. It can seek forward to
+// any position in the plaintext, by decrypting and discarding everything before it.
+type DecryptReader struct {
+	r         *bufio.Reader
+	stream    *encryptionStream
+	sealed    []byte
+	plaintext []byte
+	position  int64
+	finished  bool
+	err       error
+}
+
+// NewDecryptReader reads the header of an encrypted file, failing with ErrEncryptionKey
+// if it wasn't encrypted with our key
+func NewDecryptReader(r io.Reader, key []byte) (*DecryptReader, error) {
+	header := make([]byte, encryptionHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: incomplete header", ErrEncryptedCorrupt)
+	}
+
+	if !IsEncrypted(header) {
+		return nil, errors.New("not an encrypted file")
+	}
+
+	salt := header[len(EncryptionMagic) : len(EncryptionMagic)+encryptionSaltSize]
+	stream, check, err := newEncryptionStream(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(check, header[len(EncryptionMagic)+encryptionSaltSize:]) {
+		return nil, ErrEncryptionKey
+	}
+
+	stream.header = header
+
+	return &DecryptReader{r: bufio.NewReaderSize(r, EncryptionChunkSize+stream.aead.Overhead()), stream: stream}, nil
+}
+
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	for len(d.plaintext) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		if d.finished {
+			return 0, io.EOF
+		}
+
+		d.err = d.open()
+	}
+
+	n := copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	d.position += int64(n)
+
+	return n, nil
+}
+
+func (d *DecryptReader) open() error {
+	if d.sealed == nil {
+		d.sealed = make([]byte, EncryptionChunkSize+d.stream.aead.Overhead())
+	}
+
+	n, err := io.ReadFull(d.r, d.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return fmt.Errorf("%w: missing final chunk", ErrEncryptedCorrupt)
+		}
+
+		return err
+	}
+
+	// The last chunk is the one with nothing after it
+	_, err = d.r.Peek(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	last := err == io.EOF
+
+	plaintext, err := d.stream.aead.Open(nil, d.stream.nonce(last), d.sealed[:n], d.stream.header)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d failed to authenticate", ErrEncryptedCorrupt, d.stream.chunk)
+	}
+
+	d.stream.chunk++
+	d.plaintext, d.finished = plaintext, last
+
+	return nil
+}
+
+// Seek reports the current position in the plaintext, or moves forward to a later one.
+// We can't seek backwards, or relative to the end.
+func (d *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.position
+	case io.SeekStart:
+	default:
+		return d.position, errors.New("can only seek from the start or current position")
+	}
+
+	if offset < d.position {
+		return d.position, errors.New("cannot seek backwards in an encrypted file")
+	}
+
+	if _, err := io.CopyN(io.Discard, d, offset-d.position); err != nil {
+		return d.position, err
+	}
+
+	return d.position, nil
+}
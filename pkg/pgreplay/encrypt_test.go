@@ -0,0 +1,143 @@
+package pgreplay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+	key := []byte("0123456789abcdef")
+
+	encrypt := func(plaintext []byte) []byte {
+		var encrypted bytes.Buffer
+		encryptor, err := NewEncryptWriter(&encrypted, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Write in uneven pieces, to cross chunk boundaries mid-write
+		for len(plaintext) > 0 {
+			n := 1000
+			if n > len(plaintext) {
+				n = len(plaintext)
+			}
+
+			_, err = encryptor.Write(plaintext[:n])
+			Expect(err).NotTo(HaveOccurred())
+			plaintext = plaintext[n:]
+		}
+
+		Expect(encryptor.Close()).To(Succeed())
+		return encrypted.Bytes()
+	}
+
+	decrypt := func(encrypted []byte) ([]byte, error) {
+		decryptor, err := NewDecryptReader(bytes.NewReader(encrypted), key)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(decryptor)
+	}
+
+	random := func(size int) []byte {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		Expect(err).NotTo(HaveOccurred())
+
+		return plaintext
+	}
+
+	It("Round trips files of any size", func() {
+		for _, size := range []int{0, 1, EncryptionChunkSize, 3*EncryptionChunkSize + 17} {
+			plaintext := random(size)
+			encrypted := encrypt(plaintext)
+
+			Expect(IsEncrypted(encrypted)).To(BeTrue())
+			Expect(decrypt(encrypted)).To(Equal(plaintext))
+		}
+	})
+
+	It("Salts each file, so the same plaintext never encrypts the same way", func() {
+		plaintext := []byte("select 1\n")
+		Expect(encrypt(plaintext)).NotTo(Equal(encrypt(plaintext)))
+	})
+
+	It("Rejects the wrong key before reading any chunks", func() {
+		_, err := NewDecryptReader(bytes.NewReader(encrypt([]byte("select 1\n"))), []byte("fedcba9876543210"))
+		Expect(err).To(Equal(ErrEncryptionKey))
+	})
+
+	Context("When the file has been damaged", func() {
+		var encrypted []byte
+
+		BeforeEach(func() {
+			encrypted = encrypt(random(2*EncryptionChunkSize + 100))
+		})
+
+		It("Detects truncation", func() {
+			for _, length := range []int{
+				encryptionHeaderLen - 1,
+				encryptionHeaderLen,
+				len(encrypted) - 1,
+				len(encrypted) - 116, // leaves only the first two chunks
+			} {
+				_, err := decrypt(encrypted[:length])
+				Expect(err).To(MatchError(ErrEncryptedCorrupt), "truncated to %d bytes", length)
+			}
+		})
+
+		It("Detects tampering", func() {
+			encrypted[encryptionHeaderLen+EncryptionChunkSize] ^= 1
+
+			_, err := decrypt(encrypted)
+			Expect(err).To(MatchError(ErrEncryptedCorrupt))
+		})
+
+		It("Detects appended data", func() {
+			_, err := decrypt(append(encrypted, encrypt([]byte("select 1\n"))[encryptionHeaderLen:]...))
+			Expect(err).To(MatchError(ErrEncryptedCorrupt))
+		})
+	})
+
+	It("Seeks forward through the plaintext", func() {
+		plaintext := random(2*EncryptionChunkSize + 100)
+		decryptor, err := NewDecryptReader(bytes.NewReader(encrypt(plaintext)), key)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(decryptor.Seek(EncryptionChunkSize+50, io.SeekStart)).To(BeEquivalentTo(EncryptionChunkSize + 50))
+		Expect(decryptor.Seek(10, io.SeekCurrent)).To(BeEquivalentTo(EncryptionChunkSize + 60))
+		Expect(io.ReadAll(decryptor)).To(Equal(plaintext[EncryptionChunkSize+60:]))
+
+		_, err = decryptor.Seek(0, io.SeekStart)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Can be parsed as a JSON log", func() {
+		var log bytes.Buffer
+		for _, item := range []Item{
+			Connect{Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}},
+			Statement{Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}, "select 1"},
+		} {
+			line, err := ItemMarshalJSON(item)
+			Expect(err).NotTo(HaveOccurred())
+			log.Write(append(line, '\n'))
+		}
+
+		decryptor, err := NewDecryptReader(bytes.NewReader(encrypt(log.Bytes())), key)
+		Expect(err).NotTo(HaveOccurred())
+
+		items, _, done := ParseJSON(decryptor)
+
+		var queries []string
+		for item := range items {
+			query, _ := queryOf(item)
+			queries = append(queries, query)
+		}
+
+		Expect(<-done).NotTo(HaveOccurred())
+		Expect(queries).To(Equal([]string{"", "select 1"}))
+	})
+})
@@ -0,0 +1,320 @@
+package pgreplay
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fingerprint normalises a query so that executions differing only in their values share
+// the same fingerprint, much like pg_stat_statements. Literals and bind parameters become
+// ?, lists of them inside IN (...) collapse to a single ..., comments are removed,
+// whitespace is collapsed and unquoted identifiers and keywords are lowercased.
+//
+//	SELECT * FROM users WHERE id IN (1, 2, $1) AND name = 'alice'
+//	select * from users where id in (...) and name = ?
+func Fingerprint(query string) string {
+	tokens := collapseInLists(tokenizeQuery(query))
+
+	var fingerprint strings.Builder
+	for idx, token := range tokens {
+		if idx > 0 && token.spaced {
+			fingerprint.WriteByte(' ')
+		}
+
+		fingerprint.WriteString(token.text)
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(fingerprint.String(), ";"))
+}
+
+// FingerprintOf returns the fingerprint of the query executed by an item, if it executes
+// one
+func FingerprintOf(item Item) (string, bool) {
+	query, ok := queryOf(item)
+	if !ok {
+		return "", false
+	}
+
+	return Fingerprint(query), true
+}
+
+type queryToken struct {
+	// text is the normalised token, where literals and bind parameters have become ?
+	text string
+	kind tokenKind
+	// start and end are the position of the token in the original query
+	start, end int
+	// spaced is set when the token followed whitespace or a comment in the original query
+	spaced bool
+}
+
+type tokenKind int
+
+const (
+	tokenOther tokenKind = iota
+	tokenIdentifier
+	tokenString  // a quoted string, possibly with an E, N or U& prefix
+	tokenLiteral // any other constant, as in numbers, bit strings and dollar quotes
+	tokenParameter
+)
+
+// constant is true for literals and bind parameters
+func (t queryToken) constant() bool {
+	return t.kind == tokenString || t.kind == tokenLiteral || t.kind == tokenParameter
+}
+
+// tokenizeQuery splits a query into the tokens we need to fingerprint it. We don't parse
+// SQL, only recognise enough of its lexical structure to find constants and comments.
+func tokenizeQuery(query string) []queryToken {
+	var tokens []queryToken
+	spaced := false
+
+	var start int
+	emit := func(text string, kind tokenKind, end int) {
+		tokens = append(tokens, queryToken{text: text, kind: kind, start: start, end: end, spaced: spaced})
+		spaced = false
+	}
+
+	for pos := 0; pos < len(query); {
+		c := query[pos]
+		rest := query[pos:]
+		start = pos
+
+		switch {
+		case isSpace(c):
+			spaced = true
+			pos++
+
+		case strings.HasPrefix(rest, "--"):
+			if end := strings.IndexByte(rest, '\n'); end >= 0 {
+				pos += end
+			} else {
+				pos = len(query)
+			}
+			spaced = true
+
+		case strings.HasPrefix(rest, "/*"):
+			pos += blockCommentLength(rest)
+			spaced = true
+
+		case c == '\'':
+			pos += quotedLength(rest, '\'', false)
+			emit("?", tokenString, pos)
+
+		case (c == 'e' || c == 'E') && strings.HasPrefix(rest[1:], "'") && !followsIdentifier(query, pos):
+			pos += 1 + quotedLength(rest[1:], '\'', true)
+			emit("?", tokenString, pos)
+
+		case (c == 'u' || c == 'U') && strings.HasPrefix(rest[1:], "&'") && !followsIdentifier(query, pos):
+			pos += 2 + quotedLength(rest[2:], '\'', false)
+			emit("?", tokenString, pos)
+
+		case (c == 'n' || c == 'N') && strings.HasPrefix(rest[1:], "'") && !followsIdentifier(query, pos):
+			pos += 1 + quotedLength(rest[1:], '\'', false)
+			emit("?", tokenString, pos)
+
+		case strings.ContainsRune("bBxX", rune(c)) && strings.HasPrefix(rest[1:], "'") && !followsIdentifier(query, pos):
+			pos += 1 + quotedLength(rest[1:], '\'', false)
+			emit("?", tokenLiteral, pos)
+
+		case c == '"':
+			pos += quotedLength(rest, '"', false)
+			emit(query[start:pos], tokenIdentifier, pos)
+
+		case c == '$' && len(rest) > 1 && isDigit(rest[1]):
+			pos++
+			for pos < len(query) && isDigit(query[pos]) {
+				pos++
+			}
+			emit("?", tokenParameter, pos)
+
+		case c == '$' && dollarQuoteLength(rest) > 0:
+			pos += dollarQuoteLength(rest)
+			emit("?", tokenLiteral, pos)
+
+		case (isDigit(c) || (c == '.' && len(rest) > 1 && isDigit(rest[1]))) && !followsIdentifier(query, pos):
+			pos += numberLength(rest)
+
+			// Fold unary minus into the number, so that -1 and 1 share a fingerprint
+			if isUnaryMinus(tokens) {
+				start, spaced = tokens[len(tokens)-1].start, tokens[len(tokens)-1].spaced
+				tokens = tokens[:len(tokens)-1]
+			}
+
+			emit("?", tokenLiteral, pos)
+
+		case isIdentifierStart(rest):
+			length := 0
+			for length < len(rest) && isIdentifierPart(rest[length:]) {
+				_, size := utf8.DecodeRuneInString(rest[length:])
+				length += size
+			}
+			pos += length
+			emit(strings.ToLower(rest[:length]), tokenIdentifier, pos)
+
+		default:
+			pos++
+			emit(rest[:1], tokenOther, pos)
+		}
+	}
+
+	return tokens
+}
+
+// collapseInLists replaces lists of constants inside IN (...) with a single ..., so that
+// the length of the list doesn't change the fingerprint
+func collapseInLists(tokens []queryToken) []queryToken {
+	collapsed := make([]queryToken, 0, len(tokens))
+
+	for idx := 0; idx < len(tokens); idx++ {
+		collapsed = append(collapsed, tokens[idx])
+
+		if tokens[idx].text != "in" || idx+2 >= len(tokens) || tokens[idx+1].text != "(" {
+			continue
+		}
+
+		// Expect alternating constants and commas, ending with a closing bracket
+		end := idx + 2
+		for end < len(tokens) && tokens[end].constant() {
+			if end+1 < len(tokens) && tokens[end+1].text == "," {
+				end += 2
+				continue
+			}
+
+			end++
+			break
+		}
+
+		if end > idx+2 && end < len(tokens) && tokens[end].text == ")" && tokens[end-1].constant() {
+			collapsed = append(collapsed,
+				tokens[idx+1],
+				queryToken{text: "...", kind: tokenLiteral},
+				queryToken{text: ")"},
+			)
+			idx = end
+		}
+	}
+
+	return collapsed
+}
+
+// isUnaryMinus is true when the last token is a minus sign that can only negate whatever
+// follows it, because it follows an operator, bracket or comma rather than a value
+func isUnaryMinus(tokens []queryToken) bool {
+	if len(tokens) == 0 || tokens[len(tokens)-1].text != "-" {
+		return false
+	}
+
+	if len(tokens) == 1 {
+		return true
+	}
+
+	previous := tokens[len(tokens)-2]
+	return previous.kind == tokenOther && previous.text != ")" && previous.text != "]"
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentifierStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentifierPart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// followsIdentifier is true when the byte at pos continues an identifier, as the 1 in t1
+// or the x in idx
+func followsIdentifier(query string, pos int) bool {
+	if pos == 0 {
+		return false
+	}
+
+	r, _ := utf8.DecodeLastRuneInString(query[:pos])
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// quotedLength returns the length of the quoted string at the start of s, including its
+// quotes. Doubled quotes are escapes, as are backslashes when allowed.
+func quotedLength(s string, quote byte, backslashes bool) int {
+	for pos := 1; pos < len(s); pos++ {
+		switch {
+		case backslashes && s[pos] == '\\':
+			pos++
+		case s[pos] == quote && pos+1 < len(s) && s[pos+1] == quote:
+			pos++
+		case s[pos] == quote:
+			return pos + 1
+		}
+	}
+
+	return len(s)
+}
+
+// dollarQuoteLength returns the length of the $tag$...$tag$ string at the start of s, or
+// zero if s doesn't start with one
+func dollarQuoteLength(s string) int {
+	end := strings.IndexByte(s[1:], '$')
+	if end < 0 {
+		return 0
+	}
+
+	tag := s[:end+2]
+	for _, r := range tag[1 : len(tag)-1] {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return 0
+		}
+	}
+
+	if closing := strings.Index(s[len(tag):], tag); closing >= 0 {
+		return len(tag) + closing + len(tag)
+	}
+
+	return len(s)
+}
+
+func blockCommentLength(s string) int {
+	depth := 0
+	for pos := 0; pos+1 < len(s); pos++ {
+		switch s[pos : pos+2] {
+		case "/*":
+			depth++
+			pos++
+		case "*/":
+			depth--
+			pos++
+			if depth == 0 {
+				return pos + 1
+			}
+		}
+	}
+
+	return len(s)
+}
+
+func numberLength(s string) int {
+	length := 0
+	for length < len(s) && (isDigit(s[length]) || s[length] == '.') {
+		length++
+	}
+
+	if length < len(s) && (s[length] == 'e' || s[length] == 'E') {
+		exponent := length + 1
+		if exponent < len(s) && (s[exponent] == '+' || s[exponent] == '-') {
+			exponent++
+		}
+
+		if exponent < len(s) && isDigit(s[exponent]) {
+			length = exponent
+			for length < len(s) && isDigit(s[length]) {
+				length++
+			}
+		}
+	}
+
+	return length
+}
@@ -0,0 +1,33 @@
+package pgreplay
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fingerprint", func() {
+	DescribeTable("Normalises",
+		func(query, expected string) {
+			Expect(Fingerprint(query)).To(Equal(expected))
+		},
+		Entry("literals", "SELECT * FROM users WHERE id = 42 AND name = 'alice'", "select * from users where id = ? and name = ?"),
+		Entry("bind parameters", "select * from users where id = $1", "select * from users where id = ?"),
+		Entry("escaped quotes", "select 'it''s', E'it\\'s'", "select ?, ?"),
+		Entry("dollar quotes", "select $body$ it's $1 $body$", "select ?"),
+		Entry("decimals and exponents", "select 1.5, .5, 1e10, 2.5E-3", "select ?, ?, ?, ?"),
+		Entry("negative numbers", "select * from t where a = -1 and b - 1 > 0", "select * from t where a = ? and b - ? > ?"),
+		Entry("identifiers with digits", "select t1.col2 from t1", "select t1.col2 from t1"),
+		Entry("quoted identifiers", `SELECT "Users".id FROM "Users"`, `select "Users".id from "Users"`),
+		Entry("comments and whitespace", "select /* a /* nested */ comment */ 1 -- trailing\n  from\tdual;", "select ? from dual"),
+		Entry("IN lists", "select * from t where id in (1, 2, $1) and x not in ('a')", "select * from t where id in (...) and x not in (...)"),
+		Entry("IN subqueries", "select * from t where id in (select id from u)", "select * from t where id in (select id from u)"),
+		Entry("casts", "select '2019-02-25'::date", "select ?::date"),
+	)
+
+	It("Gives executions of the same query the same fingerprint", func() {
+		Expect(Fingerprint("SELECT * FROM t WHERE id IN (1, 2, 3)")).To(
+			Equal(Fingerprint("select *  from t where id in ($1)")),
+		)
+	})
+})
@@ -0,0 +1,33 @@
+package pgreplay
+
+import (
+	"time"
+)
+
+// detailsAt returns the details of an item from session, logged offset after
+// time20190225
+func detailsAt(offset time.Duration, session SessionID) Details {
+	return Details{Timestamp: time20190225.Add(offset), SessionID: session, User: "alice", Database: "pgreplay_test"}
+}
+
+// feed returns a closed channel that yields each of the items
+func feed(items ...Item) chan Item {
+	in := make(chan Item, len(items))
+	for _, item := range items {
+		in <- item
+	}
+
+	close(in)
+
+	return in
+}
+
+// collect drains items until the channel is closed
+func collect(items chan Item) []Item {
+	result := []Item{}
+	for item := range items {
+		result = append(result, item)
+	}
+
+	return result
+}
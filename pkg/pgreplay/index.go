@@ -0,0 +1,137 @@
+package pgreplay
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// IndexInterval is the minimum gap in log time between entries of an Index. Smaller
+// intervals make for more precise seeks at the cost of a larger index.
+var IndexInterval = time.Second
+
+// IndexPath is where we expect to find the index for a pgreplay JSON log
+func IndexPath(path string) string {
+	return path + ".idx"
+}
+
+// Index records where to find each point in time within a pgreplay JSON log, allowing
+// us to seek straight to a start time instead of parsing everything before it. It also
+// records when each session was active, so that sessions that began before the point we
+// seek to can be reopened.
+type Index struct {
+	// Size is the size of the file we indexed, allowing us to detect stale indexes
+	Size     int64          `json:"size"`
+	Entries  []IndexEntry   `json:"entries"`
+	Sessions []IndexSession `json:"sessions"`
+}
+
+// IndexEntry marks the offset of the first item logged at a timestamp. Every item before
+// this offset has an earlier timestamp.
+type IndexEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Offset    int64     `json:"offset"`
+}
+
+// IndexSession records the first and last timestamps we saw for a session
+type IndexSession struct {
+	Details
+	Last time.Time `json:"last"`
+}
+
+func LoadIndex(path string) (*Index, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &Index{}
+	return index, json.Unmarshal(payload, index)
+}
+
+func (i Index) Save(path string) error {
+	payload, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, payload, 0644)
+}
+
+// Checkpoint produces a Checkpoint at the given start time, which can be used to resume
+// a replay from that point in the indexed file.
+func (i Index) Checkpoint(start time.Time) Checkpoint {
+	checkpoint := Checkpoint{Timestamp: start, Sessions: []Details{}}
+
+	idx := sort.Search(len(i.Entries), func(idx int) bool {
+		return i.Entries[idx].Timestamp.After(start)
+	})
+
+	if idx > 0 {
+		checkpoint.Offset = i.Entries[idx-1].Offset
+	}
+
+	// Sessions that have items on either side of our start time were active at the point
+	// we're seeking to
+	for _, session := range i.Sessions {
+		if !session.Timestamp.After(start) && session.Last.After(start) {
+			checkpoint.Sessions = append(checkpoint.Sessions, session.Details)
+		}
+	}
+
+	return checkpoint
+}
+
+// IndexBuilder constructs an Index from items, which must be added in the order they
+// appear in the file along with the offset at which they begin.
+type IndexBuilder struct {
+	entries  []IndexEntry
+	sessions map[SessionID]*IndexSession
+	order    []SessionID
+	last     time.Time
+}
+
+func NewIndexBuilder() *IndexBuilder {
+	return &IndexBuilder{sessions: map[SessionID]*IndexSession{}}
+}
+
+func (b *IndexBuilder) Add(item Item, offset int64) {
+	ts := item.GetTimestamp()
+
+	// Only ever create an entry at the first item of a timestamp, so we know everything
+	// before the entry is strictly earlier
+	if len(b.entries) == 0 || (ts.After(b.last) && !ts.Before(b.entries[len(b.entries)-1].Timestamp.Add(IndexInterval))) {
+		b.entries = append(b.entries, IndexEntry{ts, offset})
+	}
+
+	if ts.After(b.last) {
+		b.last = ts
+	}
+
+	session, ok := b.sessions[item.GetSessionID()]
+	if !ok {
+		session = &IndexSession{
+			Details: Details{
+				Timestamp: ts,
+				SessionID: item.GetSessionID(),
+				User:      item.GetUser(),
+				Database:  item.GetDatabase(),
+			},
+		}
+
+		b.sessions[item.GetSessionID()] = session
+		b.order = append(b.order, item.GetSessionID())
+	}
+
+	session.Last = ts
+}
+
+// Index returns the completed index, for a file of the given size
+func (b *IndexBuilder) Index(size int64) Index {
+	index := Index{Size: size, Entries: b.entries, Sessions: make([]IndexSession, 0, len(b.order))}
+	for _, sessionID := range b.order {
+		index.Sessions = append(index.Sessions, *b.sessions[sessionID])
+	}
+
+	return index
+}
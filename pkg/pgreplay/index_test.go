@@ -0,0 +1,98 @@
+package pgreplay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Index", func() {
+	var (
+		index  Index
+		logged = []Item{
+			Connect{detailsAt(0, "a")},
+			Statement{detailsAt(0, "a"), "select 1"},
+			Connect{detailsAt(500*time.Millisecond, "b")},
+			Statement{detailsAt(time.Second, "a"), "select 2"},
+			Disconnect{detailsAt(1500*time.Millisecond, "b")},
+			Statement{detailsAt(3*time.Second, "a"), "select 3"},
+		}
+	)
+
+	BeforeEach(func() {
+		builder := NewIndexBuilder()
+		for idx, item := range logged {
+			builder.Add(item, int64(idx*100))
+		}
+
+		index = builder.Index(600)
+	})
+
+	It("Creates entries at the first item of each interval", func() {
+		Expect(index.Size).To(Equal(int64(600)))
+		Expect(index.Entries).To(Equal([]IndexEntry{
+			{time20190225, 0},
+			{time20190225.Add(time.Second), 300},
+			{time20190225.Add(3 * time.Second), 500},
+		}))
+	})
+
+	It("Records when each session was active", func() {
+		Expect(index.Sessions).To(HaveLen(2))
+		Expect(index.Sessions[1].Timestamp).To(Equal(time20190225.Add(500 * time.Millisecond)))
+		Expect(index.Sessions[1].Last).To(Equal(time20190225.Add(1500 * time.Millisecond)))
+	})
+
+	Describe("Checkpoint", func() {
+		It("Seeks to the last entry at or before the start", func() {
+			checkpoint := index.Checkpoint(time20190225.Add(2 * time.Second))
+
+			Expect(checkpoint.Offset).To(Equal(int64(300)))
+			Expect(checkpoint.Sessions).To(ConsistOf(index.Sessions[0].Details))
+		})
+
+		It("Reopens every session that spans the start", func() {
+			checkpoint := index.Checkpoint(time20190225.Add(time.Second))
+
+			Expect(checkpoint.Offset).To(Equal(int64(300)))
+			Expect(checkpoint.Sessions).To(HaveLen(2))
+		})
+
+		It("Streams every item after the start, once sessions are reopened", func() {
+			checkpoint := index.Checkpoint(time20190225.Add(time.Second))
+
+			// The Streamer mustn't filter on the start again, as the seek already applied it
+			streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+			streamer.MaxSpeed = true
+
+			stream, err := streamer.Stream(
+				context.Background(), checkpoint.Resume(feed(logged[checkpoint.Offset/100:]...), true), 1.0,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			streamed := []string{}
+			for _, item := range collect(stream) {
+				streamed = append(streamed, fmt.Sprintf("%T %s %s", item, item.GetSessionID(), item.GetTimestamp().Sub(time20190225)))
+			}
+
+			Expect(streamed).To(Equal([]string{
+				"pgreplay.Connect a 1s",
+				"pgreplay.Connect b 1s",
+				"pgreplay.Disconnect b 1.5s",
+				"pgreplay.Statement a 3s",
+			}))
+		})
+
+		It("Reads from the beginning when starting before the first entry", func() {
+			checkpoint := index.Checkpoint(time20190225.Add(-time.Second))
+
+			Expect(checkpoint.Offset).To(Equal(int64(0)))
+			Expect(checkpoint.Sessions).To(BeEmpty())
+		})
+	})
+})
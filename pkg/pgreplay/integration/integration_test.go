@@ -56,7 +56,7 @@ var _ = Describe("pgreplay", func() {
 				}
 			}()
 
-			stream, err := pgreplay.NewStreamer(nil, nil, logger).Stream(items, 1.0)
+			stream, err := pgreplay.NewStreamer(nil, nil, logger).Stream(ctx, items, 1.0)
 			Expect(err).NotTo(HaveOccurred())
 
 			errs, consumeDone := database.Consume(ctx, stream)
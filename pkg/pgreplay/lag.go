@@ -0,0 +1,151 @@
+package pgreplay
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lagSkippedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgreplay_lag_skipped_total",
+			Help: "Number of items skipped because they were too far behind schedule, by item type",
+		},
+		[]string{"type"},
+	)
+)
+
+// ErrBehindSchedule is reported for items skipped because they fell further behind
+// schedule than the Database's MaxLag
+var ErrBehindSchedule = errors.New("item too far behind schedule")
+
+// LagReportSessions bounds how many sessions a LagReport counts individually, so that a
+// long replay that falls behind doesn't accumulate an entry for every session it ran
+var LagReportSessions = 100
+
+// LagReport summarises the items skipped for falling too far behind schedule
+type LagReport struct {
+	Total  int
+	ByType map[string]int
+	// Sessions counts every session that skipped at least one item
+	Sessions int
+	// BySession counts skips for the sessions that skipped the most, up to
+	// LagReportSessions of them. Once more sessions than that have skipped items, a
+	// session that displaces another inherits its count, so may be overcounted.
+	BySession map[SessionID]int
+}
+
+// TopSessions returns up to n sessions with the most skipped items, most skipped first
+func (r LagReport) TopSessions(n int) []SessionID {
+	sessions := make([]SessionID, 0, len(r.BySession))
+	for sessionID := range r.BySession {
+		sessions = append(sessions, sessionID)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if r.BySession[sessions[i]] != r.BySession[sessions[j]] {
+			return r.BySession[sessions[i]] > r.BySession[sessions[j]]
+		}
+
+		return sessions[i] < sessions[j]
+	})
+
+	if len(sessions) > n {
+		sessions = sessions[:n]
+	}
+
+	return sessions
+}
+
+// lagTracker decides whether items are too late to execute, and counts those that are
+type lagTracker struct {
+	mu     sync.Mutex
+	report LagReport
+}
+
+func newLagTracker() *lagTracker {
+	return &lagTracker{
+		report: LagReport{ByType: map[string]int{}, BySession: map[SessionID]int{}},
+	}
+}
+
+// Skip reports whether an item that was due at the given time should be skipped, counting
+// it if so. Connect and Disconnect are never skipped, so sessions keep their connections
+// however late they are. sessionLagged says whether the item's session has already had an
+// item skipped.
+func (t *lagTracker) Skip(item Item, due time.Time, maxLag time.Duration, sessionLagged bool) bool {
+	if maxLag <= 0 || isLifecycle(item) || time.Since(due) <= maxLag {
+		return false
+	}
+
+	label := ItemLabel(item)
+	lagSkippedTotal.WithLabelValues(label).Inc()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.report.Total++
+	t.report.ByType[label]++
+	if !sessionLagged {
+		t.report.Sessions++
+	}
+
+	t.countSession(item.GetSessionID())
+
+	return true
+}
+
+// countSession counts a skip against the session, keeping only the sessions that have
+// skipped the most. This is the space-saving algorithm: when we're full, a newcomer
+// replaces the session with the fewest skips and takes over its count, so the sessions
+// that skip most persistently are never lost.
+func (t *lagTracker) countSession(sessionID SessionID) {
+	bySession := t.report.BySession
+	if _, ok := bySession[sessionID]; ok || len(bySession) < LagReportSessions {
+		bySession[sessionID]++
+		return
+	}
+
+	var fewest SessionID
+	first := true
+	for candidate, count := range bySession {
+		if first || count < bySession[fewest] || (count == bySession[fewest] && candidate < fewest) {
+			fewest, first = candidate, false
+		}
+	}
+
+	if first {
+		return // LagReportSessions is zero, so we don't track any sessions
+	}
+
+	bySession[sessionID] = bySession[fewest] + 1
+	delete(bySession, fewest)
+}
+
+// Report returns a copy of the counts so far
+func (t *lagTracker) Report() LagReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	report := LagReport{
+		Total:     t.report.Total,
+		ByType:    make(map[string]int, len(t.report.ByType)),
+		Sessions:  t.report.Sessions,
+		BySession: make(map[SessionID]int, len(t.report.BySession)),
+	}
+
+	for label, count := range t.report.ByType {
+		report.ByType[label] = count
+	}
+
+	for sessionID, count := range t.report.BySession {
+		report.BySession[sessionID] = count
+	}
+
+	return report
+}
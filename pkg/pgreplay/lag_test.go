@@ -0,0 +1,83 @@
+package pgreplay
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("lagTracker", func() {
+	var (
+		tracker *lagTracker
+		late    = time.Now().Add(-time.Minute)
+	)
+
+	detailsFor := func(session SessionID) Details {
+		return Details{Timestamp: time20190225, SessionID: session}
+	}
+
+	BeforeEach(func() {
+		tracker = newLagTracker()
+	})
+
+	It("Skips items further behind schedule than the max lag", func() {
+		Expect(tracker.Skip(Statement{detailsFor("a"), "select 1"}, late, 30*time.Second, false)).To(BeTrue())
+		Expect(tracker.Skip(Statement{detailsFor("a"), "select 1"}, time.Now(), 30*time.Second, false)).To(BeFalse())
+	})
+
+	It("Never skips without a max lag", func() {
+		Expect(tracker.Skip(Statement{detailsFor("a"), "select 1"}, late, 0, false)).To(BeFalse())
+	})
+
+	It("Never skips Connect or Disconnect", func() {
+		Expect(tracker.Skip(Connect{detailsFor("a")}, late, time.Second, false)).To(BeFalse())
+		Expect(tracker.Skip(Disconnect{detailsFor("a")}, late, time.Second, false)).To(BeFalse())
+	})
+
+	It("Counts skips per session and per type", func() {
+		tracker.Skip(Statement{detailsFor("a"), "select 1"}, late, time.Second, false)
+		tracker.Skip(BoundExecute{Execute{detailsFor("a"), "select $1"}, []interface{}{1}}, late, time.Second, true)
+		tracker.Skip(Statement{detailsFor("b"), "select 1"}, late, time.Second, false)
+
+		report := tracker.Report()
+		Expect(report.Total).To(Equal(3))
+		Expect(report.Sessions).To(Equal(2))
+		Expect(report.ByType).To(Equal(map[string]int{StatementLabel: 2, BoundExecuteLabel: 1}))
+		Expect(report.BySession).To(Equal(map[SessionID]int{"a": 2, "b": 1}))
+		Expect(report.TopSessions(1)).To(Equal([]SessionID{"a"}))
+	})
+
+	Context("With more lagging sessions than we report individually", func() {
+		BeforeEach(func() {
+			LagReportSessions = 2
+		})
+
+		AfterEach(func() {
+			LagReportSessions = 100
+		})
+
+		It("Keeps only the sessions that skipped the most", func() {
+			// lagged remembers which sessions have skipped an item, as each Conn does
+			lagged := map[SessionID]bool{}
+			skip := func(session SessionID, times int) {
+				for idx := 0; idx < times; idx++ {
+					tracker.Skip(Statement{detailsFor(session), "select 1"}, late, time.Second, lagged[session])
+					lagged[session] = true
+				}
+			}
+
+			skip("a", 5)
+			skip("b", 1)
+			skip("c", 1) // displaces b, inheriting its count
+			skip("d", 3) // displaces c in turn
+			skip("a", 1)
+
+			report := tracker.Report()
+			Expect(report.Total).To(Equal(11))
+			Expect(report.Sessions).To(Equal(4))
+			Expect(report.BySession).To(Equal(map[SessionID]int{"a": 6, "d": 5}))
+			Expect(report.TopSessions(10)).To(Equal([]SessionID{"a", "d"}))
+		})
+	})
+})
@@ -0,0 +1,119 @@
+package pgreplay
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	loopIteration = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_loop_iteration",
+			Help: "Iteration of the workload currently being read, starting at 0",
+		},
+	)
+)
+
+// LoopForever can be passed to Loop to repeat the workload until we're cancelled
+const LoopForever = 0
+
+// ParseLoopIterations parses a loop count, which is either a positive integer or
+// "forever".
+func ParseLoopIterations(input string) (int, error) {
+	if input == "forever" {
+		return LoopForever, nil
+	}
+
+	iterations, err := strconv.Atoi(input)
+	if err != nil || iterations < 1 {
+		return 0, fmt.Errorf("loop must be a positive number of iterations or 'forever': %s", input)
+	}
+
+	return iterations, nil
+}
+
+// Loop replays the items produced by open the given number of times, or until the
+// context is cancelled when looping forever. Each call to open must produce the same
+// chronologically ordered workload.
+//
+// Every iteration is shifted in time by the length of the workload, so it begins where
+// the previous iteration ended, and its session IDs are suffixed with the iteration so
+// they never collide with an earlier iteration. Any session still connected at the end
+// of an iteration is disconnected.
+func Loop(ctx context.Context, open func() chan Item, iterations int) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		var first, last time.Time
+		var seenItem bool
+
+		for iteration := 0; iterations == LoopForever || iteration < iterations; iteration++ {
+			loopIteration.Set(float64(iteration))
+
+			shift := time.Duration(iteration) * last.Sub(first)
+			active := map[SessionID]Details{}
+
+			for item := range open() {
+				if !seenItem {
+					first, seenItem = item.GetTimestamp(), true
+				}
+
+				if iteration == 0 {
+					last = item.GetTimestamp()
+				}
+
+				item = mapDetails(item, func(details Details) Details {
+					details.Timestamp = details.Timestamp.Add(shift)
+					if iteration > 0 {
+						details.SessionID = SessionID(fmt.Sprintf("%s/%d", details.SessionID, iteration))
+					}
+
+					return details
+				})
+
+				switch item.(type) {
+				case Disconnect, *Disconnect:
+					delete(active, item.GetSessionID())
+				default:
+					active[item.GetSessionID()] = Details{
+						SessionID: item.GetSessionID(),
+						User:      item.GetUser(),
+						Database:  item.GetDatabase(),
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case out <- item:
+				}
+			}
+
+			// Close every session still open at the end of the workload, so the next
+			// iteration begins with none of the connections from this one
+			for _, details := range active {
+				details.Timestamp = last.Add(shift)
+
+				select {
+				case <-ctx.Done():
+					return
+				case out <- Disconnect{details}:
+				}
+			}
+
+			// If the workload was empty, there is nothing to loop
+			if !seenItem {
+				return
+			}
+		}
+	}()
+
+	return out
+}
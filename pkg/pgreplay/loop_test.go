@@ -0,0 +1,63 @@
+package pgreplay
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Loop", func() {
+	open := func() chan Item {
+		items := make(chan Item, 3)
+		items <- Connect{detailsAt(0, "a")}
+		items <- Statement{detailsAt(time.Second, "a"), "select 1"}
+		items <- Statement{detailsAt(time.Minute, "b"), "select 2"}
+		close(items)
+
+		return items
+	}
+
+	It("Shifts each iteration and disconnects its sessions", func() {
+		looped := collect(Loop(context.Background(), open, 2))
+
+		Expect(looped).To(HaveLen(10))
+		Expect(looped[5]).To(Equal(Connect{detailsAt(time.Minute, "a/1")}))
+		Expect(looped[7]).To(Equal(Statement{detailsAt(2*time.Minute, "b/1"), "select 2"}))
+
+		for _, item := range append(looped[3:5], looped[8:]...) {
+			Expect(item).To(BeAssignableToTypeOf(Disconnect{}))
+		}
+	})
+
+	It("Loops forever until cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		looped := Loop(ctx, open, LoopForever)
+
+		for idx := 0; idx < 50; idx++ {
+			Eventually(looped).Should(Receive())
+		}
+
+		cancel()
+		Eventually(looped).Should(BeClosed())
+	})
+
+	DescribeTable("ParseLoopIterations",
+		func(input string, expected int, valid bool) {
+			iterations, err := ParseLoopIterations(input)
+			if !valid {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iterations).To(Equal(expected))
+		},
+		Entry("count", "3", 3, true),
+		Entry("forever", "forever", LoopForever, true),
+		Entry("zero", "0", 0, false),
+		Entry("garbage", "lots", 0, false),
+	)
+})
@@ -0,0 +1,144 @@
+package pgreplay
+
+import (
+	"fmt"
+	"path"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	itemsExcludedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgreplay_items_excluded_total",
+			Help: "Number of items removed by each user, database, application or session filter",
+		},
+		[]string{"filter"},
+	)
+)
+
+// Names of each filter, as used to label metrics and counts
+const (
+	FilterIncludeUser        = "include-user"
+	FilterExcludeUser        = "exclude-user"
+	FilterIncludeDatabase    = "include-database"
+	FilterExcludeDatabase    = "exclude-database"
+	FilterIncludeApplication = "include-application"
+	FilterSession            = "session"
+)
+
+var filterNames = []string{
+	FilterIncludeUser, FilterExcludeUser,
+	FilterIncludeDatabase, FilterExcludeDatabase,
+	FilterIncludeApplication, FilterSession,
+}
+
+// ItemFilter selects items by who executed them. Each field is a list of glob patterns,
+// as understood by path.Match. Items must match at least one pattern of every non-empty
+// include list, and none of the exclude patterns.
+//
+// Applications can only be matched for logs that record them, such as csvlog. Items
+// without an application never match an include pattern.
+type ItemFilter struct {
+	IncludeUsers        []string
+	ExcludeUsers        []string
+	IncludeDatabases    []string
+	ExcludeDatabases    []string
+	IncludeApplications []string
+	Sessions            []string
+
+	removed [6]atomic.Int64 // indexed as filterNames
+}
+
+// Validate checks every pattern is a valid glob
+func (f *ItemFilter) Validate() error {
+	for _, patterns := range [][]string{
+		f.IncludeUsers, f.ExcludeUsers, f.IncludeDatabases, f.ExcludeDatabases,
+		f.IncludeApplications, f.Sessions,
+	} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Empty is true when the filter has no patterns, and would keep every item
+func (f *ItemFilter) Empty() bool {
+	return len(f.IncludeUsers)+len(f.ExcludeUsers)+len(f.IncludeDatabases)+
+		len(f.ExcludeDatabases)+len(f.IncludeApplications)+len(f.Sessions) == 0
+}
+
+// Keep reports whether the item passes the filter, counting it against the first filter
+// that removed it if not
+func (f *ItemFilter) Keep(item Item) bool {
+	for idx, removes := range []bool{
+		len(f.IncludeUsers) > 0 && !matchesAny(f.IncludeUsers, item.GetUser()),
+		matchesAny(f.ExcludeUsers, item.GetUser()),
+		len(f.IncludeDatabases) > 0 && !matchesAny(f.IncludeDatabases, item.GetDatabase()),
+		matchesAny(f.ExcludeDatabases, item.GetDatabase()),
+		len(f.IncludeApplications) > 0 && !matchesAny(f.IncludeApplications, ApplicationOf(item)),
+		len(f.Sessions) > 0 && !matchesAny(f.Sessions, string(item.GetSessionID())),
+	} {
+		if removes {
+			itemsExcludedTotal.WithLabelValues(filterNames[idx]).Inc()
+			f.removed[idx].Add(1)
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// Removed returns the number of items removed by each filter so far
+func (f *ItemFilter) Removed() map[string]int64 {
+	removed := make(map[string]int64, len(filterNames))
+	for idx, name := range filterNames {
+		removed[name] = f.removed[idx].Load()
+	}
+
+	return removed
+}
+
+// Apply removes every item that doesn't pass the filter
+func (f *ItemFilter) Apply(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		for item := range items {
+			if item != nil && f.Keep(item) {
+				out <- item
+			}
+		}
+	}()
+
+	return out
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ApplicationOf returns the application_name of the item's session, or an empty string
+// if it wasn't logged
+func ApplicationOf(item Item) string {
+	if named, ok := item.(interface{ application() string }); ok {
+		return named.application()
+	}
+
+	return ""
+}
@@ -0,0 +1,95 @@
+package pgreplay
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ItemFilter", func() {
+	item := func(user, database, application string, sessionID SessionID) Item {
+		return Statement{
+			Details{
+				Timestamp:   time20190225,
+				SessionID:   sessionID,
+				User:        user,
+				Database:    database,
+				Application: application,
+			},
+			"select 1",
+		}
+	}
+
+	It("Keeps everything when empty", func() {
+		filter := &ItemFilter{}
+
+		Expect(filter.Empty()).To(BeTrue())
+		Expect(filter.Keep(item("alice", "payments", "", "a"))).To(BeTrue())
+	})
+
+	It("Requires a match for each include list", func() {
+		filter := &ItemFilter{
+			IncludeUsers:     []string{"alice", "svc_*"},
+			IncludeDatabases: []string{"payments"},
+		}
+
+		Expect(filter.Keep(item("alice", "payments", "", "a"))).To(BeTrue())
+		Expect(filter.Keep(item("svc_billing", "payments", "", "a"))).To(BeTrue())
+		Expect(filter.Keep(item("bob", "payments", "", "a"))).To(BeFalse())
+		Expect(filter.Keep(item("alice", "reporting", "", "a"))).To(BeFalse())
+	})
+
+	It("Removes anything matching an exclude pattern", func() {
+		filter := &ItemFilter{
+			ExcludeUsers:     []string{"postgres"},
+			ExcludeDatabases: []string{"template*"},
+		}
+
+		Expect(filter.Keep(item("postgres", "payments", "", "a"))).To(BeFalse())
+		Expect(filter.Keep(item("alice", "template1", "", "a"))).To(BeFalse())
+		Expect(filter.Keep(item("alice", "payments", "", "a"))).To(BeTrue())
+	})
+
+	It("Never includes items without an application", func() {
+		filter := &ItemFilter{IncludeApplications: []string{"puma*"}}
+
+		Expect(filter.Keep(item("alice", "payments", "puma: app", "a"))).To(BeTrue())
+		Expect(filter.Keep(item("alice", "payments", "psql", "a"))).To(BeFalse())
+		Expect(filter.Keep(item("alice", "payments", "", "a"))).To(BeFalse())
+	})
+
+	It("Selects sessions", func() {
+		filter := &ItemFilter{Sessions: []string{"5b1538*"}}
+
+		Expect(filter.Keep(item("alice", "payments", "", "5b153804.964"))).To(BeTrue())
+		Expect(filter.Keep(item("alice", "payments", "", "6480e39e.1c73"))).To(BeFalse())
+	})
+
+	It("Counts items against the first filter that removed them", func() {
+		filter := &ItemFilter{
+			IncludeUsers:     []string{"alice"},
+			ExcludeDatabases: []string{"reporting"},
+		}
+
+		items := make(chan Item, 4)
+		items <- item("alice", "payments", "", "a")
+		items <- item("bob", "reporting", "", "a")
+		items <- item("alice", "reporting", "", "a")
+		items <- item("alice", "reporting", "", "b")
+		close(items)
+
+		var kept []Item
+		for item := range filter.Apply(items) {
+			kept = append(kept, item)
+		}
+
+		Expect(kept).To(HaveLen(1))
+		Expect(filter.Removed()).To(HaveKeyWithValue(FilterIncludeUser, int64(1)))
+		Expect(filter.Removed()).To(HaveKeyWithValue(FilterExcludeDatabase, int64(2)))
+		Expect(filter.Removed()).To(HaveKeyWithValue(FilterSession, int64(0)))
+	})
+
+	It("Rejects invalid patterns", func() {
+		Expect((&ItemFilter{ExcludeUsers: []string{"[alice"}}).Validate()).To(HaveOccurred())
+		Expect((&ItemFilter{ExcludeUsers: []string{"alice*"}}).Validate()).To(Succeed())
+	})
+})
@@ -0,0 +1,107 @@
+package pgreplay
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Observer receives callbacks as items move through a replay, allowing callers to attach
+// their own metrics, sampling or assertions without modifying the replay itself.
+//
+// Callbacks are invoked inline with the replay, and many connections will call them
+// concurrently. Implementations must be safe for concurrent use and should return
+// quickly, as any time spent in a callback delays the replay.
+type Observer interface {
+	// ItemStreamed is called by the Streamer once an item is released at its scheduled
+	// time.
+	ItemStreamed(Item)
+	// ItemDispatched is called by the Database once an item has been placed onto the
+	// queue of its session's connection.
+	ItemDispatched(Item)
+	// ExecStarted is called immediately before an item is executed against Postgres.
+	ExecStarted(Item)
+	// ExecFinished is called after an item has been executed, with the time it took, the
+	// command tag returned by Postgres and any error.
+	ExecFinished(item Item, duration time.Duration, tag pgconn.CommandTag, err error)
+	// ItemDropped is called when the Database discards a dispatched item without
+	// executing it, with the reason it was dropped. Items abandoned because the replay
+	// was stopped or their connection died are reported with ErrReplayStopped or
+	// ErrConnectionLost.
+	ItemDropped(item Item, reason error)
+	// ConnOpened is called once a connection has been established for a session.
+	ConnOpened(SessionID)
+	// ConnClosed is called once a session's connection has finished processing items.
+	ConnClosed(SessionID)
+	// ReplayFinished is called once, after every connection has terminated. The error is
+	// the context's if the replay was stopped, or else the first error that ended a
+	// session early, such as failing to connect, and nil if the replay finished cleanly.
+	ReplayFinished(error)
+}
+
+var _ Observer = NopObserver{}
+var _ Observer = MultiObserver{}
+
+// NopObserver implements Observer by ignoring every callback. Embed it into your own type
+// to implement only the callbacks you care about.
+type NopObserver struct{}
+
+func (NopObserver) ItemStreamed(Item)                                          {}
+func (NopObserver) ItemDispatched(Item)                                        {}
+func (NopObserver) ExecStarted(Item)                                           {}
+func (NopObserver) ExecFinished(Item, time.Duration, pgconn.CommandTag, error) {}
+func (NopObserver) ItemDropped(Item, error)                                    {}
+func (NopObserver) ConnOpened(SessionID)                                       {}
+func (NopObserver) ConnClosed(SessionID)                                       {}
+func (NopObserver) ReplayFinished(error)                                       {}
+
+// MultiObserver fans each callback out to every observer, in order.
+type MultiObserver []Observer
+
+func (m MultiObserver) ItemStreamed(item Item) {
+	for _, o := range m {
+		o.ItemStreamed(item)
+	}
+}
+
+func (m MultiObserver) ItemDispatched(item Item) {
+	for _, o := range m {
+		o.ItemDispatched(item)
+	}
+}
+
+func (m MultiObserver) ExecStarted(item Item) {
+	for _, o := range m {
+		o.ExecStarted(item)
+	}
+}
+
+func (m MultiObserver) ExecFinished(item Item, duration time.Duration, tag pgconn.CommandTag, err error) {
+	for _, o := range m {
+		o.ExecFinished(item, duration, tag, err)
+	}
+}
+
+func (m MultiObserver) ItemDropped(item Item, reason error) {
+	for _, o := range m {
+		o.ItemDropped(item, reason)
+	}
+}
+
+func (m MultiObserver) ConnOpened(sessionID SessionID) {
+	for _, o := range m {
+		o.ConnOpened(sessionID)
+	}
+}
+
+func (m MultiObserver) ConnClosed(sessionID SessionID) {
+	for _, o := range m {
+		o.ConnClosed(sessionID)
+	}
+}
+
+func (m MultiObserver) ReplayFinished(err error) {
+	for _, o := range m {
+		o.ReplayFinished(err)
+	}
+}
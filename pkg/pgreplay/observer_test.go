@@ -0,0 +1,184 @@
+package pgreplay
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// recordingObserver records each callback it receives, in order
+type recordingObserver struct {
+	mu       sync.Mutex
+	events   []string
+	finished []error
+}
+
+func (o *recordingObserver) record(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+// Events returns the callbacks whose names begin with any of the given prefixes
+func (o *recordingObserver) Events(prefixes ...string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	events := []string{}
+	for _, event := range o.events {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(event, prefix) {
+				events = append(events, event)
+				break
+			}
+		}
+	}
+
+	return events
+}
+
+func (o *recordingObserver) ItemStreamed(item Item) {
+	o.record("ItemStreamed %s", describeItem(item))
+}
+
+func (o *recordingObserver) ItemDispatched(item Item) {
+	o.record("ItemDispatched %s", describeItem(item))
+}
+
+func (o *recordingObserver) ExecStarted(item Item) {
+	o.record("ExecStarted %s", describeItem(item))
+}
+
+func (o *recordingObserver) ExecFinished(item Item, _ time.Duration, _ pgconn.CommandTag, err error) {
+	o.record("ExecFinished %s %v", describeItem(item), err)
+}
+
+func (o *recordingObserver) ItemDropped(item Item, reason error) {
+	o.record("ItemDropped %s %v", describeItem(item), reason)
+}
+
+func (o *recordingObserver) ConnOpened(sessionID SessionID) {
+	o.record("ConnOpened %s", sessionID)
+}
+
+func (o *recordingObserver) ConnClosed(sessionID SessionID) {
+	o.record("ConnClosed %s", sessionID)
+}
+
+func (o *recordingObserver) ReplayFinished(err error) {
+	o.record("ReplayFinished")
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.finished = append(o.finished, err)
+}
+
+// describeItem names the item by its query, or its type if it doesn't have one
+func describeItem(item Item) string {
+	if query, ok := queryOf(item); ok {
+		return fmt.Sprintf("%s(%s)", item.GetSessionID(), query)
+	}
+
+	return fmt.Sprintf("%s(%s)", item.GetSessionID(), ItemLabel(item))
+}
+
+var _ = Describe("Observer", func() {
+	details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+	consume := func(ctx context.Context, database *Database, items chan Item) {
+		errs, done := database.Consume(ctx, items)
+		for range errs {
+			// no-op, errors are reported to the observer
+		}
+
+		Eventually(done).Should(BeClosed())
+	}
+
+	It("Fans each callback out to every observer, in order", func() {
+		first, second := &recordingObserver{}, &recordingObserver{}
+		observer := MultiObserver{first, second}
+
+		observer.ItemDispatched(Statement{details, "select 1"})
+		observer.ConnOpened("a")
+		observer.ReplayFinished(nil)
+
+		for _, recorder := range []*recordingObserver{first, second} {
+			Expect(recorder.Events("")).To(Equal([]string{
+				"ItemDispatched a(select 1)", "ConnOpened a", "ReplayFinished",
+			}))
+		}
+	})
+
+	Context("With a Database", func() {
+		var (
+			server   *fakePostgres
+			database *Database
+			observer *recordingObserver
+		)
+
+		BeforeEach(func() {
+			server = newFakePostgres()
+			observer = &recordingObserver{}
+			database = server.Database()
+			database.Observer = observer
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Receives callbacks in the order a session executes its items", func() {
+			consume(context.Background(), database, feed(
+				Connect{details},
+				Statement{details, "select 1"},
+				Statement{details, "select 2"},
+			))
+
+			Expect(observer.Events("ItemDispatched")).To(Equal([]string{
+				"ItemDispatched a(Connect)",
+				"ItemDispatched a(select 1)",
+				"ItemDispatched a(select 2)",
+			}))
+
+			Expect(observer.Events("Conn", "Exec", "ReplayFinished")).To(Equal([]string{
+				"ConnOpened a",
+				"ExecStarted a(Connect)",
+				"ExecFinished a(Connect) <nil>",
+				"ExecStarted a(select 1)",
+				"ExecFinished a(select 1) <nil>",
+				"ExecStarted a(select 2)",
+				"ExecFinished a(select 2) <nil>",
+				"ConnClosed a",
+				"ReplayFinished",
+			}))
+
+			Expect(observer.finished).To(Equal([]error{nil}))
+		})
+
+		It("Finishes with the error of a session that failed to connect", func() {
+			server.Close()
+
+			consume(context.Background(), database, feed(Connect{details}, Statement{details, "select 1"}))
+
+			Expect(observer.finished).To(HaveLen(1))
+			Expect(observer.finished[0]).To(MatchError(ContainSubstring("gave up connecting session a")))
+		})
+
+		It("Finishes with the context's error when the replay is stopped", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			consume(ctx, database, feed(Connect{details}, Statement{details, "select pg_sleep(10)"}))
+
+			Expect(observer.finished).To(Equal([]error{context.Canceled}))
+		})
+	})
+})
@@ -0,0 +1,131 @@
+package pgreplay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	orderingStallSecondsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_ordering_stall_seconds_total",
+			Help: "Time spent holding back items until all earlier items had completed",
+		},
+	)
+	orderingTimeoutsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_ordering_timeouts_total",
+			Help: "Number of items dispatched before earlier items completed, as we hit the ordering timeout",
+		},
+	)
+)
+
+// orderingBarrier tracks items that have been dispatched but not yet completed, allowing
+// us to hold back an item until every item logged before it has finished. As with the
+// Controller, every change closes the channel that waiters are watching.
+type orderingBarrier struct {
+	mu      sync.Mutex
+	pending []int64       // distinct timestamps of incomplete items, in dispatch order
+	counts  map[int64]int // number of incomplete items at each timestamp
+	changed chan struct{}
+
+	stall    time.Duration
+	timeouts int
+}
+
+func newOrderingBarrier() *orderingBarrier {
+	return &orderingBarrier{counts: map[int64]int{}, changed: make(chan struct{})}
+}
+
+// Add registers an item as dispatched. Items must be added in chronological order.
+func (b *orderingBarrier) Add(item Item) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ts := item.GetTimestamp().UnixNano()
+	if b.counts[ts] == 0 {
+		b.pending = append(b.pending, ts)
+	}
+
+	b.counts[ts]++
+}
+
+// Done marks a previously added item as completed, whether or not it succeeded
+func (b *orderingBarrier) Done(item Item) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ts := item.GetTimestamp().UnixNano()
+	if b.counts[ts] == 0 {
+		return // never added
+	}
+
+	if b.counts[ts]--; b.counts[ts] == 0 {
+		delete(b.counts, ts)
+	}
+
+	// Discard any timestamps at the head of our queue that have fully completed
+	for len(b.pending) > 0 && b.counts[b.pending[0]] == 0 {
+		b.pending = b.pending[1:]
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Wait blocks until every item added with a timestamp earlier than this item has
+// completed, or we exceed the timeout. A zero timeout waits indefinitely.
+func (b *orderingBarrier) Wait(ctx context.Context, item Item, timeout time.Duration) {
+	ts := item.GetTimestamp().UnixNano()
+	started := time.Now()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	defer func() {
+		stall := time.Since(started)
+		orderingStallSecondsTotal.Add(stall.Seconds())
+
+		b.mu.Lock()
+		b.stall += stall
+		b.mu.Unlock()
+	}()
+
+	for {
+		b.mu.Lock()
+		ready, changed := len(b.pending) == 0 || b.pending[0] >= ts, b.changed
+		b.mu.Unlock()
+
+		if ready {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			orderingTimeoutsTotal.Inc()
+
+			b.mu.Lock()
+			b.timeouts++
+			b.mu.Unlock()
+
+			return
+		case <-changed:
+		}
+	}
+}
+
+// Stall returns the total time spent waiting, and how many waits timed out
+func (b *orderingBarrier) Stall() (time.Duration, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stall, b.timeouts
+}
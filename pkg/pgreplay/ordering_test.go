@@ -0,0 +1,76 @@
+package pgreplay
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("orderingBarrier", func() {
+	var (
+		barrier *orderingBarrier
+		ctx     = context.Background()
+	)
+
+	itemAt := func(offset time.Duration, session SessionID) Item {
+		return Statement{Details{Timestamp: time20190225.Add(offset), SessionID: session}, "select 1"}
+	}
+
+	waitFor := func(item Item, timeout time.Duration) chan struct{} {
+		released := make(chan struct{})
+		go func() {
+			barrier.Wait(ctx, item, timeout)
+			close(released)
+		}()
+
+		return released
+	}
+
+	BeforeEach(func() {
+		barrier = newOrderingBarrier()
+	})
+
+	It("Releases items once earlier items complete", func() {
+		first, second := itemAt(0, "a"), itemAt(time.Millisecond, "b")
+		barrier.Add(first)
+
+		released := waitFor(second, 0)
+		Consistently(released).ShouldNot(BeClosed())
+
+		barrier.Done(first)
+		Eventually(released).Should(BeClosed())
+
+		stall, timeouts := barrier.Stall()
+		Expect(stall).To(BeNumerically(">", 0))
+		Expect(timeouts).To(Equal(0))
+	})
+
+	It("Does not hold back items with the same timestamp", func() {
+		barrier.Add(itemAt(0, "a"))
+		Eventually(waitFor(itemAt(0, "b"), 0)).Should(BeClosed())
+	})
+
+	It("Waits for every earlier item, whatever order they complete in", func() {
+		first, second := itemAt(0, "a"), itemAt(time.Millisecond, "b")
+		barrier.Add(first)
+		barrier.Add(second)
+
+		released := waitFor(itemAt(2*time.Millisecond, "c"), 0)
+
+		barrier.Done(second)
+		Consistently(released).ShouldNot(BeClosed())
+
+		barrier.Done(first)
+		Eventually(released).Should(BeClosed())
+	})
+
+	It("Gives up after the timeout", func() {
+		barrier.Add(itemAt(0, "a"))
+		Eventually(waitFor(itemAt(time.Millisecond, "b"), 10*time.Millisecond)).Should(BeClosed())
+
+		_, timeouts := barrier.Stall()
+		Expect(timeouts).To(Equal(1))
+	})
+})
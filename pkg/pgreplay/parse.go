@@ -4,9 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -50,12 +53,27 @@ type ParserFunc func(io.Reader) (items chan Item, errs chan error, done chan err
 
 // ParseJSON operates on a file of JSON serialized Item elements, and pushes the parsed
 // items down the returned channel.
+//
+// Each item remembers the byte offset of the line it was parsed from, allowing a replay
+// to later seek straight back to it. If the reader is seekable, offsets are relative to
+// the start of the file rather than our initial position.
 func ParseJSON(jsonlog io.Reader) (items chan Item, errs chan error, done chan error) {
 	items, errs, done = make(chan Item, ItemBufferSize), make(chan error), make(chan error)
 
 	go func() {
+		var offset, consumed int64
+		if seeker, ok := jsonlog.(io.Seeker); ok {
+			offset, _ = seeker.Seek(0, io.SeekCurrent)
+			consumed = offset
+		}
+
 		scanner := bufio.NewScanner(jsonlog)
 		scanner.Buffer(make([]byte, InitialScannerBufferSize), MaxLogLineSize)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := bufio.ScanLines(data, atEOF)
+			consumed += int64(advance)
+			return advance, token, err
+		})
 
 		for scanner.Scan() {
 			line := scanner.Text()
@@ -63,8 +81,11 @@ func ParseJSON(jsonlog io.Reader) (items chan Item, errs chan error, done chan e
 			if err != nil {
 				errs <- err
 			} else {
+				setSourceOffset(item, offset)
 				items <- item
 			}
+
+			offset = consumed
 		}
 
 		close(items)
@@ -80,6 +101,7 @@ func ParseJSON(jsonlog io.Reader) (items chan Item, errs chan error, done chan e
 func ParseCsvLog(csvlog io.Reader) (items chan Item, errs chan error, done chan error) {
 	reader := csv.NewReader(csvlog)
 	unbounds := map[SessionID]*Execute{}
+	errored := map[SessionID]bool{}
 	parsebuffer := make([]byte, MaxLogLineSize)
 	items, errs, done = make(chan Item, ItemBufferSize), make(chan error), make(chan error)
 
@@ -94,7 +116,7 @@ func ParseCsvLog(csvlog io.Reader) (items chan Item, errs chan error, done chan
 				errs <- err
 			}
 
-			item, err := ParseCsvItem(logline, unbounds, parsebuffer)
+			item, err := followErrors(errored)(parseCsvItem(logline, unbounds, parsebuffer))
 			if err != nil {
 				logLinesErrorTotal.Inc()
 				errs <- err
@@ -119,6 +141,7 @@ func ParseCsvLog(csvlog io.Reader) (items chan Item, errs chan error, done chan
 // parsing by sending a value down the done channel.
 func ParseErrlog(errlog io.Reader) (items chan Item, errs chan error, done chan error) {
 	unbounds := map[SessionID]*Execute{}
+	errored := map[SessionID]bool{}
 	loglinebuffer, parsebuffer := make([]byte, MaxLogLineSize), make([]byte, MaxLogLineSize)
 	scanner := NewLogScanner(errlog, loglinebuffer)
 
@@ -126,7 +149,7 @@ func ParseErrlog(errlog io.Reader) (items chan Item, errs chan error, done chan
 
 	go func() {
 		for scanner.Scan() {
-			item, err := ParseItem(scanner.Text(), unbounds, parsebuffer)
+			item, err := followErrors(errored)(parseItem(scanner.Text(), unbounds, parsebuffer))
 			if err != nil {
 				logLinesErrorTotal.Inc()
 				errs <- err
@@ -191,12 +214,22 @@ var (
 		ActionLog, "execute ",
 		regexp.MustCompile(`^.*execute (\w+)\: `),
 	}
+	// LogDurationPrefix matches the duration Postgres logs ahead of a statement when
+	// log_min_duration_statement is enabled, as in "duration: 0.043 ms  statement: ..."
+	LogDurationPrefix = LogMessage{
+		ActionLog, "duration: ",
+		regexp.MustCompile(`^duration\: (\d+\.\d+) ms(  |$)`),
+	}
 	LogError  = LogMessage{ActionError, "", regexp.MustCompile(`^ERROR\: .+`)}
 	LogDetail = LogMessage{ActionDetail, "", regexp.MustCompile(`^DETAIL\: .+`)}
 )
 
 // ParseCsvItem constructs a Item from a CSV log line. The format we accept is log_destination='csvlog'.
 func ParseCsvItem(logline []string, unbounds map[SessionID]*Execute, buffer []byte) (Item, error) {
+	return ignoreLoggedError(parseCsvItem(logline, unbounds, buffer))
+}
+
+func parseCsvItem(logline []string, unbounds map[SessionID]*Execute, buffer []byte) (Item, error) {
 	if len(logline) < 15 {
 		return nil, fmt.Errorf("failed to parse log line: '%s'", logline)
 	}
@@ -209,12 +242,19 @@ func ParseCsvItem(logline []string, unbounds map[SessionID]*Execute, buffer []by
 	// 2023-06-09 01:50:01.825 UTC,"postgres","postgres",,,64828549.7698,,,,,,,,<msg>,<params>, ....
 	user, database, session, actionLog, msg, params := logline[1], logline[2], logline[5], logline[11], logline[13], logline[14]
 
+	// application_name only appears in the csvlog of Postgres 9.0 onwards
+	var application string
+	if len(logline) > 22 {
+		application = logline[22]
+	}
+
 	extractedLog := ExtractedLog{
 		Details: Details{
-			Timestamp: ts,
-			SessionID: SessionID(session),
-			User:      user,
-			Database:  database,
+			Timestamp:   ts,
+			SessionID:   SessionID(session),
+			User:        user,
+			Database:    database,
+			Application: application,
 		},
 		ActionLog:  actionLog,
 		Message:    msg,
@@ -231,6 +271,10 @@ func ParseCsvItem(logline []string, unbounds map[SessionID]*Execute, buffer []by
 // session, as we expect following log lines to complete the Execute with the parameters
 // it should use.
 func ParseItem(logline string, unbounds map[SessionID]*Execute, buffer []byte) (Item, error) {
+	return ignoreLoggedError(parseItem(logline, unbounds, buffer))
+}
+
+func parseItem(logline string, unbounds map[SessionID]*Execute, buffer []byte) (Item, error) {
 	tokens := strings.SplitN(logline, "|", 5)
 	if len(tokens) != 5 {
 		return nil, fmt.Errorf("failed to parse log line: '%s'", logline)
@@ -260,6 +304,8 @@ func ParseItem(logline string, unbounds map[SessionID]*Execute, buffer []byte) (
 }
 
 func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionID]*Execute, buff []byte) (Item, error) {
+	el.Duration = parseLoggedDuration(el.Message, parsedFrom)
+
 	// LOG:  duration: 0.043 ms
 	// Duration logs mark completion of replay items, and are not of interest for
 	// reproducing traffic. We should only take an action if there exists an unbound item
@@ -267,6 +313,7 @@ func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionI
 	if LogDuration.Match(el.Message, parsedFrom) {
 		if unbound, ok := unbounds[el.SessionID]; ok {
 			delete(unbounds, el.SessionID)
+			unbound.Duration = el.Duration
 			return unbound.Bind(nil), nil
 		}
 
@@ -371,10 +418,12 @@ func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionI
 	}
 
 	// ERROR:  invalid value for parameter \"log_destination\": \"/var\"
-	// We don't replicate errors as this should be the minority of our traffic. Can safely
-	// ignore.
-	if el.ActionLog == "ERROR" || LogError.Match(el.Message, parsedFrom) {
-		return nil, nil
+	// We don't replicate errors as this should be the minority of our traffic, but we do
+	// tell our caller, so the session's next item can record that it followed an error.
+	// LogError's pattern includes the ERROR prefix that Match strips from errlog lines, so
+	// we check for the prefix itself too.
+	if el.ActionLog == "ERROR" || strings.HasPrefix(el.Message, ActionError) || LogError.Match(el.Message, parsedFrom) {
+		return nil, loggedError{el.SessionID}
 	}
 
 	// DETAIL:  Unrecognized key word: \"/var/log/postgres/postgres.log\"
@@ -387,6 +436,66 @@ func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionI
 	return nil, fmt.Errorf("no parser matches line: %s", el.Message)
 }
 
+// loggedError is returned when we parse an ERROR line. It isn't a failure to parse, but
+// tells the parser that the session's previous statement failed.
+type loggedError struct {
+	sessionID SessionID
+}
+
+func (e loggedError) Error() string {
+	return fmt.Sprintf("session %s logged an error", e.sessionID)
+}
+
+func ignoreLoggedError(item Item, err error) (Item, error) {
+	if errors.As(err, &loggedError{}) {
+		return nil, nil
+	}
+
+	return item, err
+}
+
+// followErrors marks the first item each session logs after an ERROR as following it,
+// consuming the loggedError so that it isn't reported as a parse failure.
+func followErrors(errored map[SessionID]bool) func(Item, error) (Item, error) {
+	return func(item Item, err error) (Item, error) {
+		var logged loggedError
+		if errors.As(err, &logged) {
+			errored[logged.sessionID] = true
+			return nil, nil
+		}
+
+		if item != nil && errored[item.GetSessionID()] {
+			delete(errored, item.GetSessionID())
+			item = mapDetails(item, func(details Details) Details {
+				details.FollowsError = true
+				return details
+			})
+		}
+
+		return item, err
+	}
+}
+
+// parseLoggedDuration extracts the duration Postgres logged alongside a message, or
+// returns zero if there isn't one
+func parseLoggedDuration(msg, parsedFrom string) time.Duration {
+	if parsedFrom == ParsedFromErrLog {
+		msg = strings.TrimPrefix(msg, LogDurationPrefix.actionType)
+	}
+
+	match := LogDurationPrefix.regex.FindStringSubmatch(msg)
+	if match == nil {
+		return 0
+	}
+
+	ms, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(math.Round(ms * float64(time.Millisecond)))
+}
+
 // ParseBindParameters constructs an interface slice from the suffix of a DETAIL parameter
 // Postgres errlog. An example input to this function would be:
 //
@@ -71,10 +71,12 @@ var _ = Describe("ParseCsvLog", func() {
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "65391eda.666f",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:   time20190225,
+							SessionID:   "65391eda.666f",
+							User:        "postgres",
+							Database:    "postgres",
+							Application: "puma: [app]",
+							Duration:    29 * time.Microsecond,
 						},
 						Query: "SELECT 1 AS one FROM \"mural_files\" WHERE (\"mural_files\".\"mural_id\" = $1) AND (\"mural_files\".\"embedded\" = $2) LIMIT $3",
 					},
@@ -83,10 +85,12 @@ var _ = Describe("ParseCsvLog", func() {
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "6539311d.13d9",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:   time20190225,
+							SessionID:   "6539311d.13d9",
+							User:        "postgres",
+							Database:    "postgres",
+							Application: "puma: [app]",
+							Duration:    28 * time.Microsecond,
 						},
 						Query: "SELECT \"roles\".* FROM \"roles\" WHERE \"roles\".\"id\" = $1 LIMIT $2",
 					},
@@ -195,6 +199,7 @@ var _ = Describe("ParseErrlog", func() {
 							SessionID: "5c7404eb.d6bd",
 							User:      "alice",
 							Database:  "pgreplay_test",
+							Duration:  326 * time.Microsecond,
 						},
 						Query: "select t.oid",
 					},
@@ -214,6 +219,21 @@ var _ = Describe("ParseErrlog", func() {
 				},
 			},
 		),
+		Entry(
+			"Marks the statement following an error",
+			`
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: begin
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: insert into logs (id) values (1)
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|ERROR:  duplicate key value violates unique constraint "logs_pkey"
+2019-02-25 15:08:27.222 GMT|bob|pgreplay_test|5c7404eb.d6be|LOG:  statement: select 1
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: commit`,
+			[]Item{
+				Statement{Details{Timestamp: time20190225, SessionID: "5c7404eb.d6bd", User: "alice", Database: "pgreplay_test"}, "begin"},
+				Statement{Details{Timestamp: time20190225, SessionID: "5c7404eb.d6bd", User: "alice", Database: "pgreplay_test"}, "insert into logs (id) values (1)"},
+				Statement{Details{Timestamp: time20190225, SessionID: "5c7404eb.d6be", User: "bob", Database: "pgreplay_test"}, "select 1"},
+				Statement{Details{Timestamp: time20190225, SessionID: "5c7404eb.d6bd", User: "alice", Database: "pgreplay_test", FollowsError: true}, "commit"},
+			},
+		),
 	)
 })
 
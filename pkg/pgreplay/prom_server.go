@@ -10,10 +10,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func StartPrometheusServer(logger kitlog.Logger, address string, port uint16) *http.Server {
+// StartPrometheusServer serves metrics from the given address. If a controller is
+// provided, we also serve the control API from /control/.
+func StartPrometheusServer(logger kitlog.Logger, address string, port uint16, controller *Controller) *http.Server {
 	// Server Configuration
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	if controller != nil {
+		mux.Handle("/control/", controller)
+	}
 	server := &http.Server{
 		Addr:    fmt.Sprintf("%s:%v", address, port),
 		Handler: mux,
@@ -31,9 +36,14 @@ func StartPrometheusServer(logger kitlog.Logger, address string, port uint16) *h
 	return server
 }
 
-func ShutdownServer(ctx context.Context, server *http.Server) error {
+// ShutdownServer keeps the server alive for the given wait, giving Prometheus the chance
+// to make a final scrape, before shutting it down gracefully.
+func ShutdownServer(ctx context.Context, server *http.Server, wait time.Duration) error {
 	// Waiting for Prometheus to get all the data left
-	time.Sleep(5 * time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
 
 	// Shutdown the server gracefully
 	if err := server.Shutdown(ctx); err != nil {
@@ -0,0 +1,216 @@
+package pgreplay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queueDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgreplay_queue_dropped_total",
+			Help: "Number of items dropped because their session's queue overflowed, by overflow policy",
+		},
+		[]string{"policy"},
+	)
+	queueBlockedSecondsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_queue_blocked_seconds_total",
+			Help: "Time spent waiting for space in a full session queue",
+		},
+	)
+)
+
+const (
+	// QueueBlock waits for space in a full queue, holding back every other session and,
+	// eventually, the Streamer
+	QueueBlock = "block"
+	// QueueDropOldest discards the item that has been queued the longest to make space
+	QueueDropOldest = "drop-oldest"
+	// QueueDropNewest discards the item we're trying to queue
+	QueueDropNewest = "drop-newest"
+	// QueueShed discards every queued item that has been waiting for longer than the shed
+	// threshold, and blocks if that doesn't make space
+	QueueShed = "shed"
+)
+
+// ErrQueueOverflow is reported for items dropped because their session's queue was full
+var ErrQueueOverflow = errors.New("session queue overflowed")
+
+// QueuePolicy determines how many items each session may have queued, and what happens
+// when a session tries to exceed that. A zero capacity leaves queues unbounded.
+type QueuePolicy struct {
+	Capacity  int
+	Overflow  string
+	ShedAfter time.Duration
+}
+
+// Validate checks the overflow policy is one we understand
+func (p QueuePolicy) Validate() error {
+	switch p.Overflow {
+	case "", QueueBlock, QueueDropOldest, QueueDropNewest:
+	case QueueShed:
+		if p.ShedAfter <= 0 {
+			return fmt.Errorf("the %s overflow policy requires a positive shed threshold", QueueShed)
+		}
+	default:
+		return fmt.Errorf("unrecognised queue overflow policy: %s", p.Overflow)
+	}
+
+	if p.Capacity < 0 {
+		return fmt.Errorf("queue capacity must not be negative")
+	}
+
+	return nil
+}
+
+type queuedItem struct {
+	item     Item
+	enqueued time.Time
+}
+
+// sessionQueue holds the items dispatched to a session until its connection is ready to
+// execute them. Connect and Disconnect items are always accepted, even when the queue is
+// full, as dropping them would leave the session's connection in the wrong state.
+type sessionQueue struct {
+	policy QueuePolicy
+	// dropped is called, without holding our lock, for every item we discard
+	dropped func(Item)
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	items    []queuedItem
+	closed   bool
+	discards []Item // dropped by the current push
+}
+
+func newSessionQueue(policy QueuePolicy, dropped func(Item)) *sessionQueue {
+	if policy.Overflow == "" {
+		policy.Overflow = QueueBlock
+	}
+
+	q := &sessionQueue{policy: policy, dropped: dropped}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// Push queues the item, applying our overflow policy if we're full
+func (q *sessionQueue) Push(item Item) {
+	q.mu.Lock()
+	q.push(item)
+	discards := q.discards
+	q.discards = nil
+	q.mu.Unlock()
+
+	for _, item := range discards {
+		queueDroppedTotal.WithLabelValues(q.policy.Overflow).Inc()
+		q.dropped(item)
+	}
+}
+
+func (q *sessionQueue) push(item Item) {
+	defer q.cond.Broadcast()
+
+	if q.policy.Capacity > 0 && len(q.items) >= q.policy.Capacity && !isLifecycle(item) {
+		switch q.policy.Overflow {
+		case QueueDropNewest:
+			q.discards = append(q.discards, item)
+			return
+		case QueueDropOldest:
+			q.discardOldest()
+		case QueueShed:
+			q.shed()
+			q.wait()
+		default:
+			q.wait()
+		}
+	}
+
+	q.items = append(q.items, queuedItem{item, time.Now()})
+}
+
+// wait blocks until we have space for another item, or until we're closed
+func (q *sessionQueue) wait() {
+	started := time.Now()
+	for !q.closed && len(q.items) >= q.policy.Capacity {
+		q.cond.Wait()
+	}
+
+	queueBlockedSecondsTotal.Add(time.Since(started).Seconds())
+}
+
+// discardOldest removes the longest queued item that isn't a Connect or Disconnect
+func (q *sessionQueue) discardOldest() {
+	for idx, queued := range q.items {
+		if !isLifecycle(queued.item) {
+			q.discards = append(q.discards, queued.item)
+			q.items = append(q.items[:idx], q.items[idx+1:]...)
+			return
+		}
+	}
+}
+
+// shed removes every item, other than Connect and Disconnect, that has been queued for
+// longer than our shed threshold
+func (q *sessionQueue) shed() {
+	threshold := time.Now().Add(-q.policy.ShedAfter)
+
+	kept := q.items[:0]
+	for _, queued := range q.items {
+		if queued.enqueued.Before(threshold) && !isLifecycle(queued.item) {
+			q.discards = append(q.discards, queued.item)
+		} else {
+			kept = append(kept, queued)
+		}
+	}
+
+	q.items = kept
+}
+
+// Pop waits for the next item, returning false once the queue is closed and empty. The
+// time the item was queued is returned alongside it.
+func (q *sessionQueue) Pop() (Item, time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if len(q.items) == 0 {
+		return nil, time.Time{}, false
+	}
+
+	queued := q.items[0]
+	q.items[0] = queuedItem{}
+	q.items = q.items[1:]
+	q.cond.Broadcast()
+
+	return queued.item, queued.enqueued, true
+}
+
+// Close prevents any more items from being queued. Items already in the queue can still
+// be popped.
+func (q *sessionQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// isLifecycle identifies the items that open and close a session's connection
+func isLifecycle(item Item) bool {
+	switch item.(type) {
+	case Connect, *Connect, Disconnect, *Disconnect:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+package pgreplay
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sessionQueue", func() {
+	var (
+		dropped []Item
+	)
+
+	statement := func(query string) Item {
+		return Statement{Details{Timestamp: time20190225, SessionID: "a"}, query}
+	}
+
+	newQueue := func(policy QueuePolicy) *sessionQueue {
+		return newSessionQueue(policy, func(item Item) {
+			dropped = append(dropped, item)
+		})
+	}
+
+	drain := func(q *sessionQueue) []Item {
+		q.Close()
+
+		items := []Item{}
+		for {
+			item, _, ok := q.Pop()
+			if !ok {
+				return items
+			}
+
+			items = append(items, item)
+		}
+	}
+
+	BeforeEach(func() {
+		dropped = nil
+	})
+
+	It("Is unbounded without a capacity", func() {
+		q := newQueue(QueuePolicy{})
+		for i := 0; i < 100; i++ {
+			q.Push(statement("select 1"))
+		}
+
+		Expect(drain(q)).To(HaveLen(100))
+		Expect(dropped).To(BeEmpty())
+	})
+
+	It("Drops the newest item when full", func() {
+		q := newQueue(QueuePolicy{Capacity: 2, Overflow: QueueDropNewest})
+		q.Push(statement("1"))
+		q.Push(statement("2"))
+		q.Push(statement("3"))
+
+		Expect(drain(q)).To(Equal([]Item{statement("1"), statement("2")}))
+		Expect(dropped).To(Equal([]Item{statement("3")}))
+	})
+
+	It("Drops the oldest item when full, sparing Connect", func() {
+		connect := Connect{Details{Timestamp: time20190225, SessionID: "a"}}
+
+		q := newQueue(QueuePolicy{Capacity: 2, Overflow: QueueDropOldest})
+		q.Push(connect)
+		q.Push(statement("1"))
+		q.Push(statement("2"))
+
+		Expect(drain(q)).To(Equal([]Item{connect, statement("2")}))
+		Expect(dropped).To(Equal([]Item{statement("1")}))
+	})
+
+	It("Always accepts Disconnect, even when full", func() {
+		disconnect := Disconnect{Details{Timestamp: time20190225, SessionID: "a"}}
+
+		q := newQueue(QueuePolicy{Capacity: 1, Overflow: QueueDropNewest})
+		q.Push(statement("1"))
+		q.Push(disconnect)
+
+		Expect(drain(q)).To(Equal([]Item{statement("1"), disconnect}))
+	})
+
+	It("Sheds items that have waited too long", func() {
+		q := newQueue(QueuePolicy{Capacity: 2, Overflow: QueueShed, ShedAfter: 10 * time.Millisecond})
+		q.Push(statement("1"))
+		time.Sleep(20 * time.Millisecond)
+		q.Push(statement("2"))
+		q.Push(statement("3"))
+
+		Expect(drain(q)).To(Equal([]Item{statement("2"), statement("3")}))
+		Expect(dropped).To(Equal([]Item{statement("1")}))
+	})
+
+	It("Blocks when full until an item is popped", func() {
+		q := newQueue(QueuePolicy{Capacity: 1, Overflow: QueueBlock})
+		q.Push(statement("1"))
+
+		pushed := make(chan struct{})
+		go func() {
+			q.Push(statement("2"))
+			close(pushed)
+		}()
+
+		Consistently(pushed).ShouldNot(BeClosed())
+
+		item, _, ok := q.Pop()
+		Expect(ok).To(BeTrue())
+		Expect(item).To(Equal(statement("1")))
+		Eventually(pushed).Should(BeClosed())
+	})
+
+	It("Rejects unknown overflow policies", func() {
+		Expect(QueuePolicy{Overflow: "panic"}.Validate()).NotTo(Succeed())
+		Expect(QueuePolicy{Overflow: QueueShed}.Validate()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,128 @@
+package pgreplay
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RateScheduleWallClock measures schedule offsets in real time since the replay began
+	RateScheduleWallClock = "wall"
+	// RateScheduleLogClock measures schedule offsets in log time since the first item
+	RateScheduleLogClock = "log"
+)
+
+// RateScheduleInterval is how often the Streamer re-evaluates a schedule while it is
+// waiting to release an item, ensuring ramps progress smoothly across quiet periods.
+var RateScheduleInterval = time.Second
+
+// RateSchedule varies the replay rate over the course of a replay. Each step sets the rate
+// at a given offset, either jumping straight to that rate or ramping linearly from the
+// previous step. Before the first step we use the first step's rate, and after the last
+// we hold the last rate.
+type RateSchedule struct {
+	Clock string
+	Steps []RateStep
+}
+
+type RateStep struct {
+	Offset time.Duration
+	Rate   float64
+	Ramp   bool
+}
+
+// ParseRateSchedule parses a schedule of comma or newline separated steps, where each
+// step is either OFFSET=RATE to jump to a rate, or OFFSET~RATE to ramp linearly to it
+// from the previous step. Offsets are Go durations, and anything after a # is ignored,
+// allowing schedules to be kept in commented files. For example:
+//
+//	0s=1, 10m=2, 20m=3, 1h~10
+//
+// ...plays at 1x for 10m, 2x for the next 10m, then 3x before ramping up to 10x between
+// 20m and 1h.
+func ParseRateSchedule(input, clock string) (*RateSchedule, error) {
+	if clock != RateScheduleWallClock && clock != RateScheduleLogClock {
+		return nil, fmt.Errorf("unrecognised schedule clock: %s", clock)
+	}
+
+	schedule := &RateSchedule{Clock: clock}
+
+	for _, line := range strings.Split(input, "\n") {
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			step, err := parseRateStep(entry)
+			if err != nil {
+				return nil, err
+			}
+
+			schedule.Steps = append(schedule.Steps, step)
+		}
+	}
+
+	if len(schedule.Steps) == 0 {
+		return nil, fmt.Errorf("rate schedule must contain at least one step")
+	}
+
+	for idx := 1; idx < len(schedule.Steps); idx++ {
+		if schedule.Steps[idx].Offset <= schedule.Steps[idx-1].Offset {
+			return nil, fmt.Errorf("rate schedule offsets must be strictly increasing")
+		}
+	}
+
+	return schedule, nil
+}
+
+func parseRateStep(entry string) (RateStep, error) {
+	idx := strings.IndexAny(entry, "=~")
+	if idx == -1 {
+		return RateStep{}, fmt.Errorf("rate schedule step must be OFFSET=RATE or OFFSET~RATE: %s", entry)
+	}
+
+	offset, err := time.ParseDuration(strings.TrimSpace(entry[:idx]))
+	if err != nil {
+		return RateStep{}, fmt.Errorf("invalid offset in rate schedule step '%s': %v", entry, err)
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(entry[idx+1:]), 64)
+	if err != nil {
+		return RateStep{}, fmt.Errorf("invalid rate in rate schedule step '%s': %v", entry, err)
+	}
+
+	if rate <= 0 || offset < 0 {
+		return RateStep{}, fmt.Errorf("rate schedule steps must have a positive rate and offset: %s", entry)
+	}
+
+	return RateStep{Offset: offset, Rate: rate, Ramp: entry[idx] == '~'}, nil
+}
+
+// RateAt returns the rate that should apply at the given offset into the schedule
+func (s RateSchedule) RateAt(offset time.Duration) float64 {
+	idx := sort.Search(len(s.Steps), func(i int) bool {
+		return s.Steps[i].Offset > offset
+	})
+
+	if idx == 0 {
+		return s.Steps[0].Rate
+	}
+
+	prev := s.Steps[idx-1]
+	if idx == len(s.Steps) || !s.Steps[idx].Ramp {
+		return prev.Rate
+	}
+
+	next := s.Steps[idx]
+	progress := float64(offset-prev.Offset) / float64(next.Offset-prev.Offset)
+
+	return prev.Rate + progress*(next.Rate-prev.Rate)
+}
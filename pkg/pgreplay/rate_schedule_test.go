@@ -0,0 +1,60 @@
+package pgreplay
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RateSchedule", func() {
+	Describe("ParseRateSchedule", func() {
+		It("Parses inline steps and ramps", func() {
+			schedule, err := ParseRateSchedule("0s=1, 10m=2,20m~3", RateScheduleWallClock)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedule.Steps).To(Equal([]RateStep{
+				{Offset: 0, Rate: 1},
+				{Offset: 10 * time.Minute, Rate: 2},
+				{Offset: 20 * time.Minute, Rate: 3, Ramp: true},
+			}))
+		})
+
+		It("Parses commented files", func() {
+			schedule, err := ParseRateSchedule("# warm the cache\n0s=1\n\n1h=2 # then double\n", RateScheduleLogClock)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedule.Clock).To(Equal(RateScheduleLogClock))
+			Expect(schedule.Steps).To(HaveLen(2))
+		})
+
+		DescribeTable("Rejects invalid schedules",
+			func(input string) {
+				_, err := ParseRateSchedule(input, RateScheduleWallClock)
+				Expect(err).To(HaveOccurred())
+			},
+			Entry("empty", ""),
+			Entry("missing rate", "10m"),
+			Entry("bad offset", "10=2"),
+			Entry("bad rate", "10m=fast"),
+			Entry("zero rate", "0s=0"),
+			Entry("out of order", "10m=1,5m=2"),
+		)
+	})
+
+	DescribeTable("RateAt",
+		func(offset time.Duration, expected float64) {
+			schedule, err := ParseRateSchedule("10m=1,20m=2,30m~4", RateScheduleWallClock)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(schedule.RateAt(offset)).To(BeNumerically("~", expected, 0.0001))
+		},
+		Entry("before first step", 0*time.Minute, 1.0),
+		Entry("at first step", 10*time.Minute, 1.0),
+		Entry("stepped", 20*time.Minute, 2.0),
+		Entry("mid-ramp", 25*time.Minute, 3.0),
+		Entry("end of ramp", 30*time.Minute, 4.0),
+		Entry("after last step", 2*time.Hour, 4.0),
+	)
+})
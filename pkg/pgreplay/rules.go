@@ -0,0 +1,273 @@
+package pgreplay
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	rulesAppliedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgreplay_rules_applied_total",
+			Help: "Number of items changed or dropped by each rule",
+		},
+		[]string{"rule", "action"},
+	)
+)
+
+const (
+	// RuleDrop removes matching items
+	RuleDrop = "drop"
+	// RuleReplace rewrites the query of matching items, replacing every match of the
+	// rule's pattern with its replacement. Replacements may refer to capture groups, as
+	// in $1.
+	RuleReplace = "replace"
+	// RuleReplaceParameter sets a bind parameter of matching items to the rule's value
+	RuleReplaceParameter = "replace-parameter"
+)
+
+// RulePresets are rule sets that ship with pgreplay, available by name
+var RulePresets = map[string]Rules{
+	// advisory-locks stops advisory locks from blocking the replay, while still asking the
+	// database to do similar work: exclusive lock attempts become a no-op cast, and
+	// unlocks release shared locks instead. Unlike the grep pipeline it replaces, it
+	// keeps SET LOCAL statements, which are only a problem once transactions have been
+	// removed and are left to a rule of their own.
+	"advisory-locks": mustParseRules(`
+rules:
+  - name: advisory-lock-to-bool
+    match:
+      query: '\bpg_try_advisory_lock\b'
+    action: replace
+    pattern: '\bpg_try_advisory_lock\b'
+    replacement: bool
+  - name: advisory-unlock-shared
+    match:
+      query: '\bpg_advisory_unlock\b'
+    action: replace
+    pattern: '\bpg_advisory_unlock\b'
+    replacement: pg_advisory_unlock_shared
+`),
+}
+
+// RulePresetNames lists the available presets, for use in help text
+func RulePresetNames() []string {
+	names := make([]string, 0, len(RulePresets))
+	for name := range RulePresets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Rules are applied in order to each item, stopping early if an item is dropped
+type Rules []*Rule
+
+// Rule changes or drops the items that match it. Every condition of the match must hold
+// for the rule to apply, and empty conditions match everything.
+type Rule struct {
+	Name  string    `yaml:"name"`
+	Match RuleMatch `yaml:"match"`
+
+	Action      string      `yaml:"action"`
+	Pattern     string      `yaml:"pattern"`
+	Replacement string      `yaml:"replacement"`
+	Parameter   int         `yaml:"parameter"` // 1-based, as in $1
+	Value       interface{} `yaml:"value"`
+
+	query   *regexp.Regexp
+	pattern *regexp.Regexp
+}
+
+type RuleMatch struct {
+	// Type is the type of item, as in Statement or BoundExecute
+	Type     string `yaml:"type"`
+	User     string `yaml:"user"`
+	Database string `yaml:"database"`
+	// Query is a regular expression that must match somewhere in the item's query.
+	// Items that don't execute a query never match.
+	Query string `yaml:"query"`
+}
+
+// LoadRules reads rules from a YAML file
+func LoadRules(path string) (Rules, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseRules(payload)
+}
+
+// ParseRules parses a YAML rules document, validating each rule
+func ParseRules(payload []byte) (Rules, error) {
+	var document struct {
+		Rules Rules `yaml:"rules"`
+	}
+
+	if err := yaml.Unmarshal(payload, &document); err != nil {
+		return nil, err
+	}
+
+	for idx, rule := range document.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", idx+1)
+		}
+
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+	}
+
+	return document.Rules, nil
+}
+
+func mustParseRules(payload string) Rules {
+	rules, err := ParseRules([]byte(payload))
+	if err != nil {
+		panic(err)
+	}
+
+	return rules
+}
+
+func (r *Rule) compile() error {
+	var err error
+
+	switch r.Match.Type {
+	case "", ConnectLabel, StatementLabel, BoundExecuteLabel, DisconnectLabel:
+	default:
+		return fmt.Errorf("unrecognised item type: %s", r.Match.Type)
+	}
+
+	if r.Match.Query != "" {
+		if r.query, err = regexp.Compile(r.Match.Query); err != nil {
+			return fmt.Errorf("invalid query match: %w", err)
+		}
+	}
+
+	switch r.Action {
+	case RuleDrop:
+	case RuleReplace:
+		if r.Pattern == "" {
+			return fmt.Errorf("replace requires a pattern")
+		}
+
+		if r.pattern, err = regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	case RuleReplaceParameter:
+		if r.Parameter < 1 {
+			return fmt.Errorf("replace-parameter requires a parameter, starting from 1")
+		}
+	default:
+		return fmt.Errorf("unrecognised action: %q", r.Action)
+	}
+
+	return nil
+}
+
+func (r *Rule) matches(item Item) bool {
+	if r.Match.Type != "" && ItemLabel(item) != r.Match.Type {
+		return false
+	}
+
+	if r.Match.User != "" && item.GetUser() != r.Match.User {
+		return false
+	}
+
+	if r.Match.Database != "" && item.GetDatabase() != r.Match.Database {
+		return false
+	}
+
+	if r.query != nil {
+		query, ok := queryOf(item)
+		if !ok || !r.query.MatchString(query) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply returns the item with the rule's action applied, or nil if it should be dropped.
+// Items are copied before being changed, so the original is never modified.
+func (r *Rule) apply(item Item) Item {
+	switch r.Action {
+	case RuleDrop:
+		return nil
+	case RuleReplace:
+		switch item := item.(type) {
+		case Statement:
+			item.Query = r.pattern.ReplaceAllString(item.Query, r.Replacement)
+			return item
+		case *Statement:
+			return r.apply(*item)
+		case BoundExecute:
+			item.Query = r.pattern.ReplaceAllString(item.Query, r.Replacement)
+			return item
+		case *BoundExecute:
+			return r.apply(*item)
+		}
+	case RuleReplaceParameter:
+		switch item := item.(type) {
+		case BoundExecute:
+			if r.Parameter <= len(item.Parameters) {
+				parameters := append([]interface{}{}, item.Parameters...)
+				parameters[r.Parameter-1] = r.Value
+				item.Parameters = parameters
+			}
+
+			return item
+		case *BoundExecute:
+			return r.apply(*item)
+		}
+	}
+
+	return item
+}
+
+// Apply runs the item through every rule, returning nil if any rule dropped it
+func (rules Rules) Apply(item Item) Item {
+	for _, rule := range rules {
+		if !rule.matches(item) {
+			continue
+		}
+
+		rulesAppliedTotal.WithLabelValues(rule.Name, rule.Action).Inc()
+		if item = rule.apply(item); item == nil {
+			return nil
+		}
+	}
+
+	return item
+}
+
+// ApplyRules applies the rules to each item, after it has been parsed
+func ApplyRules(items chan Item, rules Rules) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			if item = rules.Apply(item); item != nil {
+				out <- item
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,98 @@
+package pgreplay
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rules", func() {
+	details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+	parse := func(document string) Rules {
+		rules, err := ParseRules([]byte(document))
+		Expect(err).NotTo(HaveOccurred())
+
+		return rules
+	}
+
+	It("Drops matching items", func() {
+		rules := parse(`
+rules:
+  - match:
+      type: Statement
+      user: alice
+      query: '(?i)^set local'
+    action: drop
+`)
+
+		Expect(rules.Apply(Statement{details, "SET LOCAL statement_timeout = 0"})).To(BeNil())
+		Expect(rules.Apply(Statement{details, "select 1"})).NotTo(BeNil())
+		Expect(rules.Apply(Connect{details})).NotTo(BeNil())
+	})
+
+	It("Only matches on every condition", func() {
+		rules := parse(`
+rules:
+  - match:
+      database: other
+    action: drop
+`)
+
+		Expect(rules.Apply(Statement{details, "select 1"})).NotTo(BeNil())
+	})
+
+	It("Rewrites queries without modifying the original", func() {
+		rules := parse(`
+rules:
+  - action: replace
+    pattern: 'from (\w+)'
+    replacement: 'from archive_$1'
+`)
+
+		original := &Statement{details, "select * from payments"}
+		Expect(rules.Apply(original)).To(Equal(Statement{details, "select * from archive_payments"}))
+		Expect(original.Query).To(Equal("select * from payments"))
+	})
+
+	It("Replaces parameter values", func() {
+		rules := parse(`
+rules:
+  - match:
+      type: BoundExecute
+    action: replace-parameter
+    parameter: 2
+    value: redacted
+`)
+
+		original := BoundExecute{Execute{details, "select $1, $2"}, []interface{}{"1", "secret"}}
+		Expect(rules.Apply(original)).To(Equal(
+			BoundExecute{Execute{details, "select $1, $2"}, []interface{}{"1", "redacted"}},
+		))
+		Expect(original.Parameters[1]).To(Equal("secret"))
+	})
+
+	It("Ships the advisory lock preset", func() {
+		rules := RulePresets["advisory-locks"]
+
+		Expect(rules.Apply(Statement{details, "select pg_try_advisory_lock(1)"})).To(
+			Equal(Statement{details, "select bool(1)"}),
+		)
+		Expect(rules.Apply(Statement{details, "select pg_advisory_unlock(1)"})).To(
+			Equal(Statement{details, "select pg_advisory_unlock_shared(1)"}),
+		)
+		Expect(rules.Apply(Statement{details, "select pg_advisory_unlock_shared(1)"})).To(
+			Equal(Statement{details, "select pg_advisory_unlock_shared(1)"}),
+		)
+	})
+
+	It("Rejects invalid rules", func() {
+		_, err := ParseRules([]byte("rules: [{action: explode}]"))
+		Expect(err).To(MatchError(ContainSubstring("unrecognised action")))
+
+		_, err = ParseRules([]byte("rules: [{action: replace}]"))
+		Expect(err).To(MatchError(ContainSubstring("requires a pattern")))
+
+		_, err = ParseRules([]byte("rules: [{action: drop, match: {type: Query}}]"))
+		Expect(err).To(MatchError(ContainSubstring("unrecognised item type")))
+	})
+})
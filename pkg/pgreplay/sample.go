@@ -0,0 +1,159 @@
+package pgreplay
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sampleItemsDroppedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_sample_items_dropped_total",
+			Help: "Number of items dropped because their session wasn't sampled",
+		},
+	)
+	scaleItemsClonedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_scale_items_cloned_total",
+			Help: "Number of items added by cloning sessions",
+		},
+	)
+)
+
+// SampleSessions keeps roughly the given fraction of sessions, dropping every item of the
+// others. Whether a session is kept depends only on its ID, so a session is never split
+// and the same log always produces the same sample.
+func SampleSessions(items chan Item, fraction float64) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			if sessionHash(item.GetSessionID()) >= fraction {
+				sampleItemsDroppedTotal.Inc()
+				continue
+			}
+
+			out <- item
+		}
+	}()
+
+	return out
+}
+
+// sessionHash maps a session ID uniformly onto [0, 1)
+func sessionHash(sessionID SessionID) float64 {
+	sum := sha256.Sum256([]byte(sessionID))
+
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// ScaleSessions replays each session the given number of times, so a factor of 3 triples
+// the number of sessions. The original session is left as it was, while each clone has
+// its ID suffixed with +N and is delayed by up to jitter, so that clones don't execute in
+// lockstep with their original. Every item of a clone is delayed by the same amount,
+// preserving the order of items within each session.
+func ScaleSessions(items chan Item, factor int, jitter time.Duration) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		// Delaying clones puts items out of order, so we hold each one back until we've
+		// read an item from at least as late in the log. Jitter is bounded, so we never
+		// hold more than jitter's worth of the workload.
+		pending := &itemHeap{}
+		var sequence uint64
+
+		push := func(item Item) {
+			heap.Push(pending, sequencedItem{item, sequence})
+			sequence++
+		}
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			for pending.Len() > 0 && !(*pending)[0].GetTimestamp().After(item.GetTimestamp()) {
+				out <- heap.Pop(pending).(sequencedItem).Item
+			}
+
+			push(item)
+
+			for clone := 1; clone < factor; clone++ {
+				sessionID := SessionID(fmt.Sprintf("%s+%d", item.GetSessionID(), clone))
+				delay := time.Duration(sessionHash(sessionID) * float64(jitter))
+
+				push(mapDetails(item, func(details Details) Details {
+					details.SessionID = sessionID
+					details.Timestamp = details.Timestamp.Add(delay)
+					return details
+				}))
+
+				scaleItemsClonedTotal.Inc()
+			}
+		}
+
+		for pending.Len() > 0 {
+			out <- heap.Pop(pending).(sequencedItem).Item
+		}
+	}()
+
+	return out
+}
+
+// ValidateSampling checks the sample fraction, scale factor and jitter are usable
+func ValidateSampling(fraction float64, factor int, jitter time.Duration) error {
+	if math.IsNaN(fraction) || fraction <= 0 || fraction > 1 {
+		return fmt.Errorf("sample fraction must be greater than 0 and at most 1: %v", fraction)
+	}
+
+	if factor < 1 {
+		return fmt.Errorf("scale must be at least 1: %d", factor)
+	}
+
+	if jitter < 0 {
+		return fmt.Errorf("scale jitter must not be negative: %s", jitter)
+	}
+
+	return nil
+}
+
+// sequencedItem orders items with the same timestamp by the order we received them
+type sequencedItem struct {
+	Item
+	sequence uint64
+}
+
+type itemHeap []sequencedItem
+
+func (h itemHeap) Len() int { return len(h) }
+func (h itemHeap) Less(i, j int) bool {
+	if !h[i].GetTimestamp().Equal(h[j].GetTimestamp()) {
+		return h[i].GetTimestamp().Before(h[j].GetTimestamp())
+	}
+
+	return h[i].sequence < h[j].sequence
+}
+func (h itemHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *itemHeap) Push(x interface{}) { *h = append(*h, x.(sequencedItem)) }
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return item
+}
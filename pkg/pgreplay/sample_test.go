@@ -0,0 +1,86 @@
+package pgreplay
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sampling", func() {
+	details := func(sessionID SessionID, offset time.Duration) Details {
+		return Details{Timestamp: time20190225.Add(offset), SessionID: sessionID, User: "alice", Database: "pgreplay_test"}
+	}
+
+	Describe("SampleSessions", func() {
+		It("Keeps or drops whole sessions", func() {
+			items := make(chan Item, 3000)
+			for idx := 0; idx < 1000; idx++ {
+				sessionID := SessionID(fmt.Sprintf("5b153804.%d", idx))
+				items <- Connect{details(sessionID, 0)}
+				items <- Statement{details(sessionID, time.Second), "select 1"}
+				items <- Disconnect{details(sessionID, 2*time.Second)}
+			}
+			close(items)
+
+			counts := map[SessionID]int{}
+			for _, item := range collect(SampleSessions(items, 0.1)) {
+				counts[item.GetSessionID()]++
+			}
+
+			Expect(len(counts)).To(BeNumerically("~", 100, 30))
+			for _, count := range counts {
+				Expect(count).To(Equal(3))
+			}
+		})
+	})
+
+	Describe("ScaleSessions", func() {
+		It("Clones sessions with distinct IDs, delayed by a consistent jitter", func() {
+			items := make(chan Item, 4)
+			items <- Connect{details("a", 0)}
+			items <- Statement{details("a", time.Second), "select 1"}
+			items <- Statement{details("b", 10*time.Second), "select 2"}
+			items <- Disconnect{details("a", 20*time.Second)}
+			close(items)
+
+			scaled := collect(ScaleSessions(items, 3, 5*time.Second))
+			Expect(scaled).To(HaveLen(12))
+
+			bySession := map[SessionID][]Item{}
+			for idx, item := range scaled {
+				if idx > 0 {
+					Expect(item.GetTimestamp()).NotTo(BeTemporally("<", scaled[idx-1].GetTimestamp()))
+				}
+
+				bySession[item.GetSessionID()] = append(bySession[item.GetSessionID()], item)
+			}
+
+			Expect(bySession).To(HaveLen(6))
+			Expect(bySession["a"][0]).To(Equal(Connect{details("a", 0)}))
+
+			for _, sessionID := range []SessionID{"a+1", "a+2"} {
+				session := bySession[sessionID]
+				Expect(session).To(HaveLen(3))
+				Expect(session[0]).To(BeAssignableToTypeOf(Connect{}))
+				Expect(session[2]).To(BeAssignableToTypeOf(Disconnect{}))
+
+				delay := session[0].GetTimestamp().Sub(time20190225)
+				Expect(delay).To(BeNumerically(">=", 0))
+				Expect(delay).To(BeNumerically("<", 5*time.Second))
+				Expect(session[1].GetTimestamp()).To(Equal(time20190225.Add(time.Second + delay)))
+			}
+		})
+	})
+
+	Describe("ValidateSampling", func() {
+		It("Rejects unusable values", func() {
+			Expect(ValidateSampling(1, 1, 0)).To(Succeed())
+			Expect(ValidateSampling(0, 1, 0)).NotTo(Succeed())
+			Expect(ValidateSampling(1.5, 1, 0)).NotTo(Succeed())
+			Expect(ValidateSampling(0.5, 0, 0)).NotTo(Succeed())
+			Expect(ValidateSampling(0.5, 2, -time.Second)).NotTo(Succeed())
+		})
+	})
+})
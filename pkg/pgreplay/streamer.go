@@ -1,7 +1,7 @@
 package pgreplay
 
 import (
-	"fmt"
+	"context"
 	"time"
 
 	kitlog "github.com/go-kit/log"
@@ -39,48 +39,171 @@ type Streamer struct {
 	start  *time.Time
 	finish *time.Time
 	logger kitlog.Logger
+
+	// Observer is notified of every item as it is released from the stream
+	Observer Observer
+	// Controller, if set, allows the stream to be paused, resumed or have its rate
+	// changed while it is running
+	Controller *Controller
+	// RateSchedule, if set, replaces the rate given to Stream with one that varies over
+	// the course of the replay
+	RateSchedule *RateSchedule
+	// MaxSpeed ignores item timestamps entirely, releasing items as fast as they can be
+	// consumed. Items remain in their original order, so each session still executes its
+	// items in sequence.
+	MaxSpeed bool
 }
 
 func NewStreamer(start, finish *time.Time, logger kitlog.Logger) Streamer {
-	return Streamer{start, finish, logger}
+	return Streamer{start: start, finish: finish, logger: logger, Observer: NopObserver{}}
 }
 
 // Stream takes all the items from the given items channel and returns a channel that will
-// receive those events at a simulated given rate.
-func (s Streamer) Stream(items chan Item, rate float64) (chan Item, error) {
-	if rate < 0 {
-		return nil, fmt.Errorf("cannot support negative rates: %v", rate)
+// receive those events at a simulated given rate. Cancelling the context stops the stream,
+// closing the returned channel without sending any more items.
+//
+// The given rate is applied to the Streamer's Controller, unless an operator has already
+// overridden it, and can later be changed through the Controller. Whenever the rate
+// changes or we resume after a pause, we rebase our schedule to the current position in
+// the logs so that we continue from where we left off, instead of bursting to catch-up
+// with the original schedule.
+//
+// If the Streamer has a RateSchedule then it replaces the given rate, and we adjust the
+// rate through the Controller as the replay progresses, until someone overrides the rate
+// by hand.
+func (s Streamer) Stream(ctx context.Context, items chan Item, rate float64) (chan Item, error) {
+	control := s.Controller
+	if control == nil {
+		control = NewController()
+	}
+
+	if s.RateSchedule != nil {
+		rate = s.RateSchedule.RateAt(0)
+	}
+
+	// An operator may already have overridden the rate, which we should keep
+	if err := control.SetScheduledRate(rate); err != nil {
+		return nil, err
 	}
 
 	out := make(chan Item)
 
 	go func() {
-		var first, start time.Time
+		defer close(out)
+
+		var origin, first, start, began time.Time
 		var seenItem bool
 
+		rate, paused, changed := control.State()
+
+		// position is how far through the logs we've progressed at the given time
+		position := func(now time.Time) time.Time {
+			if paused {
+				return first
+			}
+
+			return first.Add(time.Duration(float64(now.Sub(start)) * rate))
+		}
+
+		// rebase moves our anchors to the point we've reached in the logs, before applying
+		// whatever state the controller has most recently changed to.
+		rebase := func() {
+			now := time.Now()
+			if seenItem {
+				first = position(now)
+			}
+
+			start = now
+			rate, paused, changed = control.State()
+		}
+
+		// follow applies the rate schedule, if we have one, for the current offset
+		follow := func() {
+			if s.RateSchedule == nil {
+				return
+			}
+
+			now := time.Now()
+			offset := now.Sub(began)
+			if s.RateSchedule.Clock == RateScheduleLogClock {
+				offset = position(now).Sub(origin)
+			}
+
+			if scheduled := s.RateSchedule.RateAt(offset); scheduled != rate {
+				control.SetScheduledRate(scheduled)
+			}
+		}
+
 		for item := range s.Filter(items) {
 			if !seenItem {
-				first = item.GetTimestamp()
-				start = time.Now()
+				origin, first = item.GetTimestamp(), item.GetTimestamp()
+				start, began = time.Now(), time.Now()
 				seenItem = true
 			}
 
-			elapsedSinceStart := time.Duration(rate) * time.Since(start)
-			elapsedSinceFirst := item.GetTimestamp().Sub(first)
+			// scheduled is when the item should be executed, which at max speed is as soon
+			// as we release it
+			scheduled := time.Now()
+
+			for {
+				follow()
+
+				var wait, tick <-chan time.Time
+				if s.RateSchedule != nil {
+					tick = time.After(RateScheduleInterval)
+				}
+
+				if !paused {
+					if s.MaxSpeed {
+						break
+					}
+
+					// Our item is due once we've progressed as far as its timestamp, which at
+					// our current rate will happen at this moment
+					due := start.Add(time.Duration(float64(item.GetTimestamp().Sub(first)) / rate))
+					scheduled = due
+
+					diff := time.Until(due)
+					if diff <= 0 {
+						break
+					}
+
+					wait = time.After(diff)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+					rebase()
+					continue
+				case <-tick:
+					continue
+				case <-wait:
+				}
 
-			if diff := elapsedSinceFirst - elapsedSinceStart; diff > 0 {
-				time.Sleep(time.Duration(float64(diff) / rate))
+				break
 			}
 
+			// Anything downstream that holds the item back, such as a full session queue or
+			// waiting on strict ordering, makes it late against this schedule
+			item = mapDetails(item, func(details Details) Details {
+				details.scheduled = scheduled
+				return details
+			})
+
 			level.Debug(s.logger).Log(
 				"event", "queing.item",
 				"sessionID", string(item.GetSessionID()),
 				"user", string(item.GetUser()),
 			)
-			out <- item
+			select {
+			case <-ctx.Done():
+				return
+			case out <- item:
+				s.Observer.ItemStreamed(item)
+			}
 		}
-
-		close(out)
 	}()
 
 	return out, nil
@@ -93,6 +216,9 @@ func (s Streamer) Stream(items chan Item, rate float64) (chan Item, error) {
 //
 // This function assumes that items are pushed down the channel in chronological order.
 func (s Streamer) Filter(items chan Item) chan Item {
+	// The first item after our start is consumed while we search for it, so we hold onto
+	// it to send before any other
+	var first Item
 	if s.start != nil {
 		for item := range items {
 			if item == nil {
@@ -100,6 +226,7 @@ func (s Streamer) Filter(items chan Item) chan Item {
 			}
 
 			if item.GetTimestamp().After(*s.start) {
+				first = item
 				break
 			}
 
@@ -110,28 +237,41 @@ func (s Streamer) Filter(items chan Item) chan Item {
 	out := make(chan Item, StreamFilterBufferSize)
 
 	go func() {
+		defer close(out)
+
+		if first != nil && !s.filterFinish(first, out) {
+			return
+		}
+
 		for item := range items {
 			if item == nil {
 				continue
 			}
 
-			if s.finish != nil {
-				if item.GetTimestamp().After(*s.finish) {
-					break
-				}
-
-				if s.start != nil {
-					itemsFilterProgressFraction.Set(
-						float64(item.GetTimestamp().Sub(*s.start)) / float64((*s.finish).Sub(*s.start)),
-					)
-				}
+			if !s.filterFinish(item, out) {
+				return
 			}
-
-			out <- item
 		}
-
-		close(out)
 	}()
 
 	return out
 }
+
+// filterFinish sends the item to out unless it comes after our finish, returning false
+// once we're finished
+func (s Streamer) filterFinish(item Item, out chan Item) bool {
+	if s.finish != nil {
+		if item.GetTimestamp().After(*s.finish) {
+			return false
+		}
+
+		if s.start != nil {
+			itemsFilterProgressFraction.Set(
+				float64(item.GetTimestamp().Sub(*s.start)) / float64((*s.finish).Sub(*s.start)),
+			)
+		}
+	}
+
+	out <- item
+	return true
+}
@@ -0,0 +1,172 @@
+package pgreplay
+
+import (
+	"context"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streamer", func() {
+	// streamItems produces statements at each of the given offsets from our fixed time
+	streamItems := func(offsets ...time.Duration) chan Item {
+		items := make(chan Item, len(offsets))
+		for _, offset := range offsets {
+			items <- Statement{Details{Timestamp: time20190225.Add(offset), SessionID: "a"}, "select 1"}
+		}
+
+		close(items)
+		return items
+	}
+
+	// replayDuration measures how long it takes for every item to be streamed
+	replayDuration := func(streamer Streamer, items chan Item, rate float64) time.Duration {
+		stream, err := streamer.Stream(context.Background(), items, rate)
+		Expect(err).NotTo(HaveOccurred())
+
+		start := time.Now()
+		for range stream {
+			// no-op, just wait for every item
+		}
+
+		return time.Since(start)
+	}
+
+	DescribeTable("Replays at fractional rates",
+		func(rate float64, expected time.Duration) {
+			streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+			items := streamItems(0, 50*time.Millisecond, 100*time.Millisecond)
+
+			Expect(replayDuration(streamer, items, rate)).To(
+				BeNumerically("~", expected, 40*time.Millisecond),
+			)
+		},
+		Entry("1x", 1.0, 100*time.Millisecond),
+		Entry("0.5x", 0.5, 200*time.Millisecond),
+		Entry("1.5x", 1.5, 66*time.Millisecond),
+		Entry("2.5x", 2.5, 40*time.Millisecond),
+	)
+
+	It("Ignores timestamps at max speed", func() {
+		streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+		streamer.MaxSpeed = true
+		items := streamItems(0, time.Hour, 2*time.Hour)
+
+		Expect(replayDuration(streamer, items, 1.0)).To(BeNumerically("<", 100*time.Millisecond))
+	})
+
+	It("Keeps the first item after the start", func() {
+		start := time20190225.Add(time.Second)
+		streamer := NewStreamer(&start, nil, kitlog.NewNopLogger())
+
+		filtered := collect(streamer.Filter(streamItems(0, time.Second, 2*time.Second, 3*time.Second)))
+
+		Expect(filtered).To(HaveLen(2))
+		Expect(filtered[0].GetTimestamp()).To(Equal(time20190225.Add(2 * time.Second)))
+	})
+
+	It("Rejects non-positive rates", func() {
+		streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+
+		_, err := streamer.Stream(context.Background(), streamItems(), 0)
+		Expect(err).To(MatchError(ContainSubstring("must be positive")))
+	})
+
+	It("Continues from where it paused", func() {
+		controller := NewController()
+		streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+		streamer.Controller = controller
+
+		controller.Pause()
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			controller.Resume()
+		}()
+
+		items := streamItems(0, 50*time.Millisecond)
+		Expect(replayDuration(streamer, items, 1.0)).To(
+			BeNumerically("~", 150*time.Millisecond, 40*time.Millisecond),
+		)
+	})
+
+	It("Keeps a rate an operator set before the replay started", func() {
+		controller := NewController()
+		Expect(controller.OverrideRate(2)).To(Succeed())
+
+		streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+		streamer.Controller = controller
+		streamer.RateSchedule = &RateSchedule{Steps: []RateStep{{Offset: 0, Rate: 0.5}}}
+
+		Expect(replayDuration(streamer, streamItems(0, 100*time.Millisecond), 1.0)).To(
+			BeNumerically("~", 50*time.Millisecond, 40*time.Millisecond),
+		)
+		Expect(controller.Rate()).To(Equal(2.0))
+	})
+
+	It("Stamps each item with when it was scheduled, however late it is consumed", func() {
+		streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+		stream, err := streamer.Stream(context.Background(), streamItems(0, 50*time.Millisecond), 1.0)
+		Expect(err).NotTo(HaveOccurred())
+
+		var first, second Item
+		Eventually(stream).Should(Receive(&first))
+
+		// Stall the consumer well beyond the second item's schedule
+		time.Sleep(200 * time.Millisecond)
+		Eventually(stream).Should(Receive(&second))
+
+		Expect(scheduledAt(second).Sub(scheduledAt(first))).To(
+			BeNumerically("~", 50*time.Millisecond, 20*time.Millisecond),
+		)
+		Expect(time.Since(scheduledAt(second))).To(BeNumerically(">", 100*time.Millisecond))
+	})
+
+	Context("When cancelled", func() {
+		It("Stops while waiting for an item to become due", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+
+			stream, err := streamer.Stream(ctx, streamItems(0, time.Hour), 1.0)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(stream).Should(Receive())
+
+			cancel()
+			Eventually(stream, 100*time.Millisecond).Should(BeClosed())
+		})
+
+		It("Stops while waiting for its items to be consumed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+			streamer.MaxSpeed = true
+
+			stream, err := streamer.Stream(ctx, streamItems(0, 0, 0), 1.0)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Nothing is reading, so the Streamer is blocked sending the first item. Give it
+			// time to notice the cancellation before we look, so it can't hand us the item.
+			cancel()
+			time.Sleep(50 * time.Millisecond)
+
+			Expect(stream).To(BeClosed())
+		})
+
+		It("Stops while paused", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			controller := NewController()
+			controller.Pause()
+
+			streamer := NewStreamer(nil, nil, kitlog.NewNopLogger())
+			streamer.Controller = controller
+
+			stream, err := streamer.Stream(ctx, streamItems(0), 1.0)
+			Expect(err).NotTo(HaveOccurred())
+
+			cancel()
+			Eventually(stream, 100*time.Millisecond).Should(BeClosed())
+		})
+	})
+})
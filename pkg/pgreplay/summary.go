@@ -0,0 +1,70 @@
+package pgreplay
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var _ Observer = &Summary{}
+
+// Summary is an Observer that accumulates totals across a replay, so that we can report
+// on what happened once the replay has finished, however it finished.
+type Summary struct {
+	NopObserver
+
+	started     time.Time
+	streamed    atomic.Int64
+	dispatched  atomic.Int64
+	executed    atomic.Int64
+	errored     atomic.Int64
+	dropped     atomic.Int64
+	abandoned   atomic.Int64
+	connections atomic.Int64
+	execTime    atomic.Int64 // nanoseconds
+}
+
+func NewSummary() *Summary {
+	return &Summary{started: time.Now()}
+}
+
+func (s *Summary) ItemStreamed(Item)    { s.streamed.Add(1) }
+func (s *Summary) ItemDispatched(Item)  { s.dispatched.Add(1) }
+func (s *Summary) ConnOpened(SessionID) { s.connections.Add(1) }
+
+// ItemDropped distinguishes items we abandoned, because the replay stopped or their
+// connection died, from those we chose not to execute
+func (s *Summary) ItemDropped(_ Item, reason error) {
+	if errors.Is(reason, ErrReplayStopped) || errors.Is(reason, ErrConnectionLost) {
+		s.abandoned.Add(1)
+	} else {
+		s.dropped.Add(1)
+	}
+}
+
+func (s *Summary) ExecFinished(_ Item, duration time.Duration, _ pgconn.CommandTag, err error) {
+	s.executed.Add(1)
+	s.execTime.Add(int64(duration))
+	if err != nil {
+		s.errored.Add(1)
+	}
+}
+
+// Log writes the summary as a single log line
+func (s *Summary) Log(logger kitlog.Logger) {
+	logger.Log(
+		"event", "replay.summary",
+		"elapsed", time.Since(s.started).String(),
+		"items_streamed", s.streamed.Load(),
+		"items_dispatched", s.dispatched.Load(),
+		"items_executed", s.executed.Load(),
+		"items_errored", s.errored.Load(),
+		"items_dropped", s.dropped.Load(),
+		"items_abandoned", s.abandoned.Load(),
+		"connections", s.connections.Load(),
+		"exec_time", time.Duration(s.execTime.Load()).String(),
+	)
+}
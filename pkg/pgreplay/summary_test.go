@@ -0,0 +1,79 @@
+package pgreplay
+
+import (
+	"errors"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// summaryLog captures the fields of the line a Summary logs
+func summaryLog(summary *Summary) map[string]interface{} {
+	fields := map[string]interface{}{}
+	summary.Log(kitlog.LoggerFunc(func(keyvals ...interface{}) error {
+		for idx := 0; idx+1 < len(keyvals); idx += 2 {
+			fields[keyvals[idx].(string)] = keyvals[idx+1]
+		}
+
+		return nil
+	}))
+
+	return fields
+}
+
+var _ = Describe("Summary", func() {
+	details := Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+	It("Counts what happened to every item", func() {
+		summary := NewSummary()
+		items := []Item{
+			Connect{details},
+			Statement{details, "select 1"},
+			Statement{details, "select 2"},
+			Statement{details, "select 3"},
+			Statement{details, "select 4"},
+			Statement{details, "select 5"},
+			Disconnect{details},
+		}
+
+		summary.ConnOpened("a")
+		for _, item := range items {
+			summary.ItemStreamed(item)
+			summary.ItemDispatched(item)
+		}
+
+		summary.ExecFinished(items[0], time.Second, pgconn.CommandTag{}, nil)
+		summary.ExecFinished(items[1], 2*time.Second, pgconn.CommandTag{}, nil)
+		summary.ExecFinished(items[2], time.Second, pgconn.CommandTag{}, errors.New("syntax error"))
+		summary.ItemDropped(items[3], ErrBehindSchedule)
+		summary.ItemDropped(items[4], ErrReplayStopped)
+		summary.ItemDropped(items[5], ErrConnectionLost)
+		summary.ItemDropped(items[6], ErrReplayStopped)
+
+		Expect(summaryLog(summary)).To(And(
+			HaveKeyWithValue("event", "replay.summary"),
+			HaveKeyWithValue("items_streamed", int64(7)),
+			HaveKeyWithValue("items_dispatched", int64(7)),
+			HaveKeyWithValue("items_executed", int64(3)),
+			HaveKeyWithValue("items_errored", int64(1)),
+			HaveKeyWithValue("items_dropped", int64(1)),
+			HaveKeyWithValue("items_abandoned", int64(3)),
+			HaveKeyWithValue("connections", int64(1)),
+			HaveKeyWithValue("exec_time", "4s"),
+		))
+	})
+
+	It("Reports nothing abandoned when nothing was dispatched", func() {
+		summary := NewSummary()
+		summary.ItemStreamed(Statement{details, "select 1"})
+
+		Expect(summaryLog(summary)).To(And(
+			HaveKeyWithValue("items_dispatched", int64(0)),
+			HaveKeyWithValue("items_abandoned", int64(0)),
+		))
+	})
+})
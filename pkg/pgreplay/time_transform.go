@@ -0,0 +1,149 @@
+package pgreplay
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	timeIdleCollapsedSeconds = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_time_idle_collapsed_seconds_total",
+			Help: "Seconds of idle time removed from the workload by collapsing quiet periods",
+		},
+	)
+	timeIdleCollapsedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_time_idle_collapsed_total",
+			Help: "Number of idle gaps collapsed",
+		},
+	)
+)
+
+// TimeTransform moves the timestamps of items, changing when a replay executes them.
+//
+// Idle gaps, where no item in any session is logged for longer than CollapseIdleOver,
+// are shortened to CollapseIdleTo, moving everything after them earlier. Every item is
+// then moved by Shift, and by a random amount of up to Jitter either way. Jitter is
+// independent for each item, so it varies the time between items without the workload
+// drifting from its schedule. No item is ever moved before an earlier item of its
+// session, so each session keeps its order.
+type TimeTransform struct {
+	CollapseIdleOver time.Duration
+	CollapseIdleTo   time.Duration
+	Shift            time.Duration
+	Jitter           time.Duration
+
+	// Random provides the jitter, defaulting to the global source
+	Random *rand.Rand
+}
+
+// Validate checks the transform is usable
+func (t TimeTransform) Validate() error {
+	if t.CollapseIdleOver < 0 || t.CollapseIdleTo < 0 {
+		return fmt.Errorf("idle gaps must not be negative")
+	}
+
+	if t.CollapseIdleOver > 0 && t.CollapseIdleTo >= t.CollapseIdleOver {
+		return fmt.Errorf("must collapse idle gaps over %s to something shorter, not %s", t.CollapseIdleOver, t.CollapseIdleTo)
+	}
+
+	if t.Jitter < 0 {
+		return fmt.Errorf("jitter must not be negative: %s", t.Jitter)
+	}
+
+	return nil
+}
+
+// Empty is true when the transform leaves every timestamp alone
+func (t TimeTransform) Empty() bool {
+	return t.CollapseIdleOver == 0 && t.Shift == 0 && t.Jitter == 0
+}
+
+// Apply transforms the timestamp of each item, expecting items in the order they were
+// logged and producing them in the order of their new timestamps
+func (t TimeTransform) Apply(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		var previous time.Time
+		var collapsed time.Duration
+
+		// Jitter can move an item before those we've already seen, so we hold items back
+		// until nothing we read later could be moved before them. Like ScaleSessions, this
+		// never holds more than jitter's worth of the workload.
+		pending := &itemHeap{}
+		var sequence uint64
+
+		// The latest timestamp we've given each session, which none of its later items may
+		// precede
+		sessions := map[SessionID]time.Time{}
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			logged := item.GetTimestamp()
+			if !previous.IsZero() && t.CollapseIdleOver > 0 {
+				if gap := logged.Sub(previous); gap > t.CollapseIdleOver {
+					collapsed += gap - t.CollapseIdleTo
+					timeIdleCollapsedSeconds.Add((gap - t.CollapseIdleTo).Seconds())
+					timeIdleCollapsedTotal.Inc()
+				}
+			}
+
+			previous = logged
+
+			scheduled := logged.Add(t.Shift - collapsed)
+			for pending.Len() > 0 && !(*pending)[0].GetTimestamp().After(scheduled.Add(-t.Jitter)) {
+				out <- heap.Pop(pending).(sequencedItem).Item
+			}
+
+			timestamp := scheduled.Add(t.jitter())
+			if latest, ok := sessions[item.GetSessionID()]; ok && timestamp.Before(latest) {
+				timestamp = latest
+			}
+
+			switch item.(type) {
+			case Disconnect, *Disconnect:
+				delete(sessions, item.GetSessionID())
+			default:
+				sessions[item.GetSessionID()] = timestamp
+			}
+
+			heap.Push(pending, sequencedItem{mapDetails(item, func(details Details) Details {
+				details.Timestamp = timestamp
+				return details
+			}), sequence})
+			sequence++
+		}
+
+		for pending.Len() > 0 {
+			out <- heap.Pop(pending).(sequencedItem).Item
+		}
+	}()
+
+	return out
+}
+
+// jitter picks a random offset between -Jitter and Jitter
+func (t TimeTransform) jitter() time.Duration {
+	if t.Jitter == 0 {
+		return 0
+	}
+
+	random := rand.Int63n
+	if t.Random != nil {
+		random = t.Random.Int63n
+	}
+
+	return time.Duration(random(2*int64(t.Jitter)+1)) - t.Jitter
+}
@@ -0,0 +1,117 @@
+package pgreplay
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TimeTransform", func() {
+	details := func(sessionID SessionID, offset time.Duration) Details {
+		return Details{Timestamp: time20190225.Add(offset), SessionID: sessionID, User: "alice", Database: "pgreplay_test"}
+	}
+
+	transform := func(transform TimeTransform, logged ...Item) []Item {
+		items := make(chan Item, len(logged))
+		for _, item := range logged {
+			items <- item
+		}
+		close(items)
+
+		var transformed []Item
+		for item := range transform.Apply(items) {
+			transformed = append(transformed, item)
+		}
+
+		return transformed
+	}
+
+	offsets := func(items []Item) []time.Duration {
+		var offsets []time.Duration
+		for _, item := range items {
+			offsets = append(offsets, item.GetTimestamp().Sub(time20190225))
+		}
+
+		return offsets
+	}
+
+	It("Collapses idle gaps across every session", func() {
+		transformed := transform(
+			TimeTransform{CollapseIdleOver: time.Minute, CollapseIdleTo: 5 * time.Second},
+			Connect{details("a", 0)},
+			Statement{details("b", 30*time.Second), "select 1"},
+			Statement{details("a", 8*time.Hour), "select 2"},
+			Statement{details("b", 8*time.Hour+time.Second), "select 3"},
+			Disconnect{details("a", 10*time.Hour)},
+		)
+
+		Expect(offsets(transformed)).To(Equal([]time.Duration{
+			0, 30 * time.Second, 35 * time.Second, 36 * time.Second, 41 * time.Second,
+		}))
+		Expect(transformed[2]).To(Equal(Statement{details("a", 35*time.Second), "select 2"}))
+	})
+
+	It("Shifts every item", func() {
+		Expect(offsets(transform(
+			TimeTransform{Shift: -time.Hour},
+			Connect{details("a", 0)},
+			Disconnect{details("a", time.Second)},
+		))).To(Equal([]time.Duration{-time.Hour, -time.Hour + time.Second}))
+	})
+
+	It("Jitters items within bounds, preserving the order of each session", func() {
+		var logged []Item
+		for idx := 0; idx < 1000; idx++ {
+			sessionID := SessionID(fmt.Sprintf("5b153804.%d", idx%10))
+			logged = append(logged, Statement{details(sessionID, time.Duration(idx)*time.Millisecond), fmt.Sprintf("select %d", idx)})
+		}
+
+		transformed := transform(TimeTransform{Jitter: 50 * time.Millisecond, Random: rand.New(rand.NewSource(1))}, logged...)
+		Expect(transformed).To(HaveLen(len(logged)))
+
+		moved := 0
+		last := map[SessionID]int{}
+		for idx, item := range transformed {
+			if idx > 0 {
+				Expect(item.GetTimestamp()).NotTo(BeTemporally("<", transformed[idx-1].GetTimestamp()))
+			}
+
+			var number int
+			_, err := fmt.Sscanf(item.(Statement).Query, "select %d", &number)
+			Expect(err).NotTo(HaveOccurred())
+
+			if previous, ok := last[item.GetSessionID()]; ok {
+				Expect(number).To(BeNumerically(">", previous))
+			}
+			last[item.GetSessionID()] = number
+
+			original := time20190225.Add(time.Duration(number) * time.Millisecond)
+			if !item.GetTimestamp().Equal(original) {
+				moved++
+			}
+
+			Expect(item.GetTimestamp()).To(BeTemporally("~", original, 50*time.Millisecond))
+		}
+
+		Expect(moved).To(BeNumerically(">", 900))
+	})
+
+	DescribeTable("Validate",
+		func(transform TimeTransform, valid bool) {
+			if valid {
+				Expect(transform.Validate()).To(Succeed())
+			} else {
+				Expect(transform.Validate()).NotTo(Succeed())
+			}
+		},
+		Entry("empty", TimeTransform{}, true),
+		Entry("collapsing", TimeTransform{CollapseIdleOver: time.Hour, CollapseIdleTo: time.Minute}, true),
+		Entry("collapsing to longer", TimeTransform{CollapseIdleOver: time.Minute, CollapseIdleTo: time.Hour}, false),
+		Entry("negative jitter", TimeTransform{Jitter: -time.Second}, false),
+		Entry("negative shift", TimeTransform{Shift: -time.Hour}, true),
+	)
+})
@@ -0,0 +1,61 @@
+package pgreplay
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	statementTimeoutsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_statement_timeouts_total",
+			Help: "Number of statements cancelled for exceeding their deadline",
+		},
+	)
+)
+
+// StatementTimeout decides how long each statement may run before we cancel it.
+//
+// Absolute applies to every statement. Factor instead allows each statement a multiple of
+// its original duration, for statements that were logged with one, but never less than
+// Floor, so that fast statements aren't cancelled over a few milliseconds. When both are
+// set, a statement's deadline is whichever comes first. Zero values disable each limit.
+type StatementTimeout struct {
+	Absolute time.Duration
+	Factor   float64
+	Floor    time.Duration
+}
+
+// For returns the deadline for executing the given item, or zero if it has none. Connect
+// and Disconnect are never given a deadline.
+func (t StatementTimeout) For(item Item) time.Duration {
+	if isLifecycle(item) {
+		return 0
+	}
+
+	timeout := t.Absolute
+
+	if duration := itemDuration(item); t.Factor > 0 && duration > 0 {
+		relative := time.Duration(float64(duration) * t.Factor)
+		if relative < t.Floor {
+			relative = t.Floor
+		}
+
+		if timeout == 0 || relative < timeout {
+			timeout = relative
+		}
+	}
+
+	return timeout
+}
+
+// itemDuration is the logged duration of the item, or zero if it doesn't have one
+func itemDuration(item Item) time.Duration {
+	if timed, ok := item.(interface{ loggedDuration() time.Duration }); ok {
+		return timed.loggedDuration()
+	}
+
+	return 0
+}
@@ -0,0 +1,43 @@
+package pgreplay
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StatementTimeout", func() {
+	statementTaking := func(duration time.Duration) Item {
+		return Statement{Details{Timestamp: time20190225, SessionID: "a", Duration: duration}, "select 1"}
+	}
+
+	It("Applies an absolute timeout to every statement", func() {
+		timeout := StatementTimeout{Absolute: time.Minute}
+
+		Expect(timeout.For(statementTaking(0))).To(Equal(time.Minute))
+		Expect(timeout.For(statementTaking(time.Second))).To(Equal(time.Minute))
+	})
+
+	It("Scales the logged duration, no lower than the floor", func() {
+		timeout := StatementTimeout{Factor: 10, Floor: time.Second}
+
+		Expect(timeout.For(statementTaking(time.Second))).To(Equal(10 * time.Second))
+		Expect(timeout.For(statementTaking(time.Millisecond))).To(Equal(time.Second))
+		Expect(timeout.For(statementTaking(0))).To(BeZero())
+	})
+
+	It("Takes whichever deadline comes first", func() {
+		timeout := StatementTimeout{Absolute: time.Minute, Factor: 10}
+
+		Expect(timeout.For(statementTaking(time.Second))).To(Equal(10 * time.Second))
+		Expect(timeout.For(statementTaking(time.Hour))).To(Equal(time.Minute))
+	})
+
+	It("Never times out Connect or Disconnect", func() {
+		timeout := StatementTimeout{Absolute: time.Minute}
+
+		Expect(timeout.For(Connect{Details{SessionID: "a"}})).To(BeZero())
+		Expect(timeout.For(Disconnect{Details{SessionID: "a"}})).To(BeZero())
+	})
+})
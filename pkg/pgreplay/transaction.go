@@ -0,0 +1,354 @@
+package pgreplay
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	transactionsSkippedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_transactions_skipped_total",
+			Help: "Number of transactions skipped because they failed when originally logged",
+		},
+	)
+	transactionsReleasedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_transactions_released_total",
+			Help: "Number of transactions replayed without knowing whether they failed, as waiting for them to end would have held back too many items",
+		},
+	)
+	transactionsAbortedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_transactions_aborted_total",
+			Help: "Number of transactions rolled back during replay because one of their statements failed",
+		},
+	)
+)
+
+const (
+	// TransactionsKeep replays every statement as logged, including those that control
+	// transactions
+	TransactionsKeep = "keep"
+	// TransactionsAbort replays transactions as logged, but once a statement fails we skip
+	// the rest of its transaction and roll it back
+	TransactionsAbort = "abort"
+	// TransactionsFlatten drops the statements that control transactions, so every
+	// statement runs in its own transaction
+	TransactionsFlatten = "flatten"
+	// TransactionsSkipFailed drops every item of a transaction that was rolled back in the
+	// original log, failed with an error, or whose session disconnected before it finished
+	TransactionsSkipFailed = "skip-failed"
+)
+
+// ErrTransactionAborted is reported for items skipped because an earlier statement in
+// their transaction failed
+var ErrTransactionAborted = errors.New("transaction aborted by an earlier error")
+
+type transactionControl int
+
+const (
+	txControlNone transactionControl = iota
+	txControlBegin
+	txControlCommit
+	txControlRollback
+	txControlSavepoint // SAVEPOINT and RELEASE
+	txControlRollbackTo
+)
+
+// controlOf identifies statements that control transactions
+func controlOf(item Item) transactionControl {
+	query, ok := queryOf(item)
+	if !ok {
+		return txControlNone
+	}
+
+	fields := strings.Fields(strings.ToLower(strings.TrimSuffix(strings.TrimSpace(query), ";")))
+	if len(fields) == 0 {
+		return txControlNone
+	}
+
+	switch fields[0] {
+	case "begin":
+		return txControlBegin
+	case "start":
+		if len(fields) > 1 && fields[1] == "transaction" {
+			return txControlBegin
+		}
+	case "commit", "end":
+		if len(fields) > 1 && fields[1] == "prepared" {
+			return txControlNone
+		}
+
+		return txControlCommit
+	case "prepare":
+		if len(fields) > 1 && fields[1] == "transaction" {
+			return txControlCommit
+		}
+	case "rollback", "abort":
+		if len(fields) > 1 && fields[1] == "prepared" {
+			return txControlNone
+		}
+
+		for _, field := range fields[1:] {
+			if field == "to" {
+				return txControlRollbackTo
+			}
+		}
+
+		return txControlRollback
+	case "savepoint", "release":
+		return txControlSavepoint
+	}
+
+	return txControlNone
+}
+
+// queryOf returns the query executed by an item, if it executes one
+func queryOf(item Item) (string, bool) {
+	switch item := item.(type) {
+	case Statement:
+		return item.Query, true
+	case *Statement:
+		return item.Query, true
+	case BoundExecute:
+		return item.Query, true
+	case *BoundExecute:
+		return item.Query, true
+	}
+
+	return "", false
+}
+
+// TransactionOf returns the transaction the item belongs to, or zero if it wasn't part
+// of an explicit transaction
+func TransactionOf(item Item) uint64 {
+	if grouped, ok := item.(interface{ transaction() uint64 }); ok {
+		return grouped.transaction()
+	}
+
+	return 0
+}
+
+// followsError is true for the first item a session logged after an error
+func followsError(item Item) bool {
+	if followed, ok := item.(interface{ followsError() bool }); ok {
+		return followed.followsError()
+	}
+
+	return false
+}
+
+// GroupTransactions tags every item between a session's BEGIN and the COMMIT or ROLLBACK
+// that ends it, inclusive, with an identifier unique to that transaction. A Disconnect
+// in the middle of a transaction ends it, and is tagged too.
+func GroupTransactions(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		var last uint64
+		open := map[SessionID]uint64{}
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			sessionID := item.GetSessionID()
+			if controlOf(item) == txControlBegin && open[sessionID] == 0 {
+				last++
+				open[sessionID] = last
+			}
+
+			if transaction := open[sessionID]; transaction != 0 {
+				item = withTransaction(item, transaction)
+			}
+
+			if endsTransaction(item) {
+				delete(open, sessionID)
+			}
+
+			out <- item
+		}
+	}()
+
+	return out
+}
+
+// endsTransaction identifies the items that end a transaction
+func endsTransaction(item Item) bool {
+	switch item.(type) {
+	case Disconnect, *Disconnect:
+		return true
+	}
+
+	control := controlOf(item)
+	return control == txControlCommit || control == txControlRollback
+}
+
+func withTransaction(item Item, transaction uint64) Item {
+	return mapDetails(item, func(details Details) Details {
+		details.Transaction = transaction
+		return details
+	})
+}
+
+// FlattenTransactions drops every statement that controls a transaction, so each
+// remaining statement runs in its own transaction.
+func FlattenTransactions(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		for item := range items {
+			if item != nil && controlOf(item) == txControlNone {
+				out <- item
+			}
+		}
+	}()
+
+	return out
+}
+
+// SkipFailedTransactionsBuffer bounds how many items SkipFailedTransactions holds back
+// while waiting for transactions to end
+var SkipFailedTransactionsBuffer = 100000
+
+// SkipFailedTransactions drops every item of a transaction that was rolled back in the
+// original log, or that was left unfinished when its session disconnected. Items must
+// already be grouped into transactions, and we never drop Connect or Disconnect.
+//
+// Postgres rolls back a transaction that is committed after one of its statements failed,
+// so we also drop transactions in which any item follows an ERROR, unless that item is a
+// ROLLBACK TO SAVEPOINT that recovered from it. This requires a log that records errors.
+//
+// We can't know whether a transaction failed until it ends, so every item from the start
+// of a transaction onwards is held back until then, preserving the order of items
+// across sessions. Long transactions will hold back the replay for as long as they ran.
+// Once we're holding back SkipFailedTransactionsBuffer items, we stop waiting on the
+// oldest open transaction and release it without knowing whether it failed.
+func SkipFailedTransactions(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		defer close(out)
+
+		var pending []Item
+		failed := map[uint64]bool{}   // transactions that have ended, and whether they failed
+		erred := map[uint64]bool{}    // open transactions that have already logged an error
+		released := map[uint64]bool{} // open transactions we've stopped waiting on
+
+		// flush emits every pending item we've decided on, or everything if we've reached
+		// the end of the log and will never know whether open transactions failed
+		flush := func(all bool) {
+			for len(pending) > 0 {
+				item, transaction := pending[0], TransactionOf(pending[0])
+
+				outcome, ended := failed[transaction]
+				if transaction != 0 && !ended && !released[transaction] && !all {
+					return
+				}
+
+				pending[0] = nil
+				pending = pending[1:]
+
+				if !outcome || isLifecycle(item) {
+					out <- item
+				}
+
+				if transaction != 0 && endsTransaction(item) {
+					delete(failed, transaction)
+					delete(released, transaction)
+				}
+			}
+		}
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			if transaction := TransactionOf(item); transaction != 0 && !released[transaction] {
+				control := controlOf(item)
+				if followsError(item) && control != txControlBegin && control != txControlRollbackTo {
+					erred[transaction] = true
+				}
+
+				if endsTransaction(item) {
+					failed[transaction] = control != txControlCommit || erred[transaction]
+					delete(erred, transaction)
+
+					if failed[transaction] {
+						transactionsSkippedTotal.Inc()
+					}
+				}
+			}
+
+			pending = append(pending, item)
+			flush(false)
+
+			// We only hold items back for an open transaction at the head of our buffer,
+			// which we'll release if it's holding back too much
+			for len(pending) > SkipFailedTransactionsBuffer {
+				transaction := TransactionOf(pending[0])
+				released[transaction] = true
+				delete(erred, transaction)
+				transactionsReleasedTotal.Inc()
+
+				flush(false)
+			}
+		}
+
+		flush(true)
+	}()
+
+	return out
+}
+
+// abortTransaction applies TransactionsAbort before executing an item. If an earlier
+// statement of the item's transaction failed, the item is skipped, unless it ends the
+// transaction, in which case we roll back instead.
+func (c *Conn) abortTransaction(item Item) (Item, bool) {
+	transaction := TransactionOf(item)
+	if !c.db.AbortTransactions || transaction == 0 || transaction != c.tx.aborted || isLifecycle(item) {
+		return item, true
+	}
+
+	switch controlOf(item) {
+	case txControlCommit, txControlRollback:
+		c.tx.aborted = 0
+		transactionsAbortedTotal.Inc()
+
+		details := Details{
+			Timestamp:   item.GetTimestamp(),
+			SessionID:   item.GetSessionID(),
+			User:        item.GetUser(),
+			Database:    item.GetDatabase(),
+			Application: ApplicationOf(item),
+			Transaction: transaction,
+		}
+
+		return Statement{details, "rollback"}, true
+	}
+
+	return item, false
+}
+
+// failTransaction records whether an item failed, so that we can skip the rest of its
+// transaction
+func (c *Conn) failTransaction(ctx context.Context, item Item, err error) {
+	if !c.db.AbortTransactions || err == nil || ctx.Err() != nil || endsTransaction(item) {
+		return
+	}
+
+	if transaction := TransactionOf(item); transaction != 0 {
+		c.tx.aborted = transaction
+	}
+}
@@ -0,0 +1,149 @@
+package pgreplay
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transactions", func() {
+	detailsFor := func(session SessionID) Details {
+		return Details{Timestamp: time20190225, SessionID: session}
+	}
+
+	statement := func(session SessionID, query string) Item {
+		return Statement{detailsFor(session), query}
+	}
+
+	queries := func(items []Item) []string {
+		result := []string{}
+		for _, item := range items {
+			if query, ok := queryOf(item); ok {
+				result = append(result, query)
+			} else {
+				result = append(result, ItemLabel(item))
+			}
+		}
+
+		return result
+	}
+
+	DescribeTable("controlOf",
+		func(query string, expected transactionControl) {
+			Expect(controlOf(statement("a", query))).To(Equal(expected))
+		},
+		Entry("BEGIN", "BEGIN", txControlBegin),
+		Entry("start transaction", "start transaction isolation level serializable", txControlBegin),
+		Entry("COMMIT;", "COMMIT;", txControlCommit),
+		Entry("rollback", "rollback", txControlRollback),
+		Entry("rollback to savepoint", "ROLLBACK TO SAVEPOINT a", txControlRollbackTo),
+		Entry("savepoint", "savepoint a", txControlSavepoint),
+		Entry("commit prepared", "commit prepared 'a'", txControlNone),
+		Entry("select", "select 1", txControlNone),
+	)
+
+	It("Groups each session's transactions", func() {
+		grouped := collect(GroupTransactions(feed(
+			statement("a", "select 0"),
+			statement("a", "begin"),
+			statement("b", "select 1"),
+			statement("a", "select 2"),
+			statement("a", "commit"),
+			statement("b", "begin"),
+			Disconnect{detailsFor("b")},
+		)))
+
+		transactions := []uint64{}
+		for _, item := range grouped {
+			transactions = append(transactions, TransactionOf(item))
+		}
+
+		Expect(transactions).To(Equal([]uint64{0, 1, 0, 1, 1, 2, 2}))
+	})
+
+	It("Flattens transactions", func() {
+		flattened := collect(FlattenTransactions(feed(
+			statement("a", "begin"),
+			statement("a", "savepoint x"),
+			statement("a", "select 1"),
+			statement("a", "commit"),
+		)))
+
+		Expect(queries(flattened)).To(Equal([]string{"select 1"}))
+	})
+
+	It("Skips transactions that failed originally, preserving order", func() {
+		kept := collect(SkipFailedTransactions(GroupTransactions(feed(
+			statement("a", "begin"),
+			statement("b", "begin"),
+			statement("a", "insert 1"),
+			statement("c", "select 1"),
+			statement("b", "insert 2"),
+			statement("a", "rollback"),
+			statement("b", "commit"),
+			statement("c", "begin"),
+			statement("c", "insert 3"),
+			Disconnect{detailsFor("c")},
+		))))
+
+		Expect(queries(kept)).To(Equal([]string{
+			"begin", "select 1", "insert 2", "commit", DisconnectLabel,
+		}))
+	})
+
+	It("Skips transactions that were committed after an error, which Postgres rolls back", func() {
+		afterError := func(item Item) Item {
+			return mapDetails(item, func(details Details) Details {
+				details.FollowsError = true
+				return details
+			})
+		}
+
+		kept := collect(SkipFailedTransactions(GroupTransactions(feed(
+			statement("a", "select 1"),
+			afterError(statement("a", "begin")), // the error came before the transaction
+			statement("a", "insert 1"),
+			statement("a", "commit"),
+			statement("b", "begin"),
+			statement("b", "insert 2"),
+			afterError(statement("b", "commit")),
+			statement("c", "begin"),
+			statement("c", "savepoint s"),
+			statement("c", "insert 3"),
+			afterError(statement("c", "rollback to savepoint s")), // recovers from the error
+			statement("c", "commit"),
+		))))
+
+		Expect(queries(kept)).To(Equal([]string{
+			"select 1", "begin", "insert 1", "commit",
+			"begin", "savepoint s", "insert 3", "rollback to savepoint s", "commit",
+		}))
+	})
+
+	Context("When a transaction holds back too many items", func() {
+		BeforeEach(func() {
+			SkipFailedTransactionsBuffer = 2
+		})
+
+		AfterEach(func() {
+			SkipFailedTransactionsBuffer = 100000
+		})
+
+		It("Releases it without knowing whether it failed", func() {
+			kept := collect(SkipFailedTransactions(GroupTransactions(feed(
+				statement("a", "begin"),
+				statement("b", "select 1"),
+				statement("b", "select 2"),
+				statement("b", "select 3"),
+				statement("a", "rollback"),
+				statement("c", "begin"),
+				statement("c", "insert 1"),
+				statement("c", "rollback"),
+			))))
+
+			Expect(queries(kept)).To(Equal([]string{
+				"begin", "select 1", "select 2", "select 3", "rollback",
+			}))
+		})
+	})
+})
@@ -0,0 +1,151 @@
+package pgreplay
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	txAbortedStatementsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_tx_aborted_statements_total",
+			Help: "Number of statements that failed because their transaction had already aborted",
+		},
+	)
+	txAutoRollbacksTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_tx_auto_rollbacks_total",
+			Help: "Number of times we rolled back a session stuck in an aborted transaction",
+		},
+	)
+	txStatementsSavedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_tx_statements_saved_total",
+			Help: "Number of statements that succeeded because we rolled back their session's aborted transaction",
+		},
+	)
+	txStatementsLostTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_tx_statements_lost_total",
+			Help: "Number of successful statements whose effects were discarded when we rolled back their transaction",
+		},
+	)
+)
+
+const (
+	// TxRecoveryNone leaves sessions in aborted transactions alone, so their statements
+	// fail until the log happens to end the transaction
+	TxRecoveryNone = "none"
+	// TxRecoveryRollback issues a ROLLBACK as soon as a session stuck in an aborted
+	// transaction tries to run anything other than the end of that transaction
+	TxRecoveryRollback = "rollback"
+)
+
+// Postgres transaction status, as reported by pgconn's TxStatus
+const (
+	txStatusIdle   = 'I'
+	txStatusActive = 'T'
+	txStatusFailed = 'E'
+)
+
+// TxRecoveryReport summarises the effect of rolling back aborted transactions
+type TxRecoveryReport struct {
+	Aborted   int64 // statements that failed inside an aborted transaction
+	Rollbacks int64
+	Saved     int64
+	Lost      int64
+}
+
+type txRecoveryStats struct {
+	aborted, rollbacks, saved, lost atomic.Int64
+}
+
+func (s *txRecoveryStats) Report() TxRecoveryReport {
+	return TxRecoveryReport{
+		Aborted:   s.aborted.Load(),
+		Rollbacks: s.rollbacks.Load(),
+		Saved:     s.saved.Load(),
+		Lost:      s.lost.Load(),
+	}
+}
+
+// txState tracks a connection's progress through its current transaction
+type txState struct {
+	// statements is the number of successful statements in the current transaction
+	statements int64
+	// recovered is set once we've rolled back an aborted transaction, until the log ends
+	// the transaction itself
+	recovered bool
+	// aborted is the transaction we're skipping, after one of its statements failed
+	aborted uint64
+}
+
+// recoverTx rolls back an aborted transaction before executing the item, if our policy
+// asks us to and the item wouldn't end the transaction itself.
+func (c *Conn) recoverTx(ctx context.Context, item Item) {
+	if c.db.TxRecovery != TxRecoveryRollback || isLifecycle(item) {
+		return
+	}
+
+	if recoversTransaction(item) {
+		c.tx.recovered = false
+		return
+	}
+
+	if c.PgConn().TxStatus() == txStatusFailed {
+		if _, err := c.handle(ctx, Statement{Query: "rollback"}); err == nil {
+			txAutoRollbacksTotal.Inc()
+			txStatementsLostTotal.Add(float64(c.tx.statements))
+			c.db.txStats.rollbacks.Add(1)
+			c.db.txStats.lost.Add(c.tx.statements)
+
+			c.tx = txState{recovered: true}
+		}
+	}
+}
+
+// trackTx updates our view of the transaction once an item has executed. Statements that
+// succeed after we've recovered their transaction count as saved, as they would otherwise
+// have failed.
+func (c *Conn) trackTx(item Item, err error) {
+	if isLifecycle(item) || c.IsClosed() {
+		return
+	}
+
+	if c.tx.recovered && err == nil {
+		txStatementsSavedTotal.Inc()
+		c.db.txStats.saved.Add(1)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "25P02" { // in_failed_sql_transaction
+		txAbortedStatementsTotal.Inc()
+		c.db.txStats.aborted.Add(1)
+	}
+
+	switch c.PgConn().TxStatus() {
+	case txStatusIdle:
+		c.tx.statements = 0
+	case txStatusActive:
+		// BEGIN has no effects to lose
+		if err == nil && controlOf(item) != txControlBegin {
+			c.tx.statements++
+		}
+	}
+}
+
+// recoversTransaction identifies statements that end an aborted transaction, or roll it
+// back to a savepoint from which it can continue
+func recoversTransaction(item Item) bool {
+	switch controlOf(item) {
+	case txControlCommit, txControlRollback, txControlRollbackTo:
+		return true
+	}
+
+	return false
+}
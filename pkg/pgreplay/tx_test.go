@@ -0,0 +1,92 @@
+package pgreplay
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("recoversTransaction", func() {
+	DescribeTable("Identifies statements that recover an aborted transaction",
+		func(item Item, expected bool) {
+			Expect(recoversTransaction(item)).To(Equal(expected))
+		},
+		Entry("ROLLBACK", Statement{Details{}, "ROLLBACK"}, true),
+		Entry("rollback to savepoint", Statement{Details{}, "rollback to savepoint a"}, true),
+		Entry("COMMIT;", Statement{Details{}, "  COMMIT;"}, true),
+		Entry("end", &Statement{Details{}, "end"}, true),
+		Entry("abort", BoundExecute{Execute{Details{}, "abort"}, nil}, true),
+		Entry("BEGIN", Statement{Details{}, "BEGIN"}, false),
+		Entry("savepoint", Statement{Details{}, "savepoint a"}, false),
+		Entry("select", Statement{Details{}, "select 'commit'"}, false),
+		Entry("Disconnect", Disconnect{Details{}}, false),
+	)
+})
+
+var _ = Describe("Transaction recovery", func() {
+	var (
+		server   *fakePostgres
+		database *Database
+	)
+
+	BeforeEach(func() {
+		server = newFakePostgres()
+		database = server.Database()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// replay runs a session whose transaction aborts after one successful statement,
+	// continuing with a statement that succeeds outside the transaction and one that
+	// fails either way, before the log finally commits
+	replay := func() {
+		details := detailsAt(0, "a")
+
+		items := feed(
+			Connect{details},
+			Statement{details, "begin"},
+			Statement{details, "select 1"},
+			Statement{details, "select 1/0"},
+			Statement{details, "select 2"},
+			Statement{details, "select 1/0"},
+			Statement{details, "COMMIT"},
+			Disconnect{details},
+		)
+
+		errs, done := database.Consume(context.Background(), items)
+		for range errs {
+			// no-op, we check what the server received
+		}
+
+		Eventually(done).Should(BeClosed())
+	}
+
+	It("Rolls back the aborted transaction, counting only statements that then succeed", func() {
+		database.TxRecovery = TxRecoveryRollback
+		replay()
+
+		Expect(server.Queries()).To(Equal([]string{
+			"begin", "select 1", "select 1/0", "rollback", "select 2", "select 1/0", "COMMIT",
+		}))
+		Expect(database.TxRecoveryReport()).To(Equal(TxRecoveryReport{
+			Aborted:   0,
+			Rollbacks: 1,
+			Saved:     1,
+			Lost:      1,
+		}))
+	})
+
+	It("Leaves the transaction aborted without recovery", func() {
+		database.TxRecovery = TxRecoveryNone
+		replay()
+
+		Expect(server.Queries()).To(Equal([]string{
+			"begin", "select 1", "select 1/0", "select 2", "select 1/0", "COMMIT",
+		}))
+		Expect(database.TxRecoveryReport()).To(Equal(TxRecoveryReport{Aborted: 2}))
+	})
+})
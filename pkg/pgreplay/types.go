@@ -9,6 +9,7 @@ import (
 	"time"
 
 	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	jsoniter "github.com/json-iterator/go"
 )
 
@@ -71,24 +72,35 @@ const (
 	DisconnectLabel   = "Disconnect"
 )
 
-func ItemMarshalJSON(item Item) ([]byte, error) {
-	type envelope struct {
-		Type string `json:"type"`
-		Item Item   `json:"item"`
-	}
-
+// ItemLabel names the type of item, or returns an empty string for items we don't
+// recognise
+func ItemLabel(item Item) string {
 	switch item.(type) {
 	case Connect, *Connect:
-		return json.Marshal(envelope{Type: ConnectLabel, Item: item})
+		return ConnectLabel
 	case Statement, *Statement:
-		return json.Marshal(envelope{Type: StatementLabel, Item: item})
+		return StatementLabel
 	case BoundExecute, *BoundExecute:
-		return json.Marshal(envelope{Type: BoundExecuteLabel, Item: item})
+		return BoundExecuteLabel
 	case Disconnect, *Disconnect:
-		return json.Marshal(envelope{Type: DisconnectLabel, Item: item})
+		return DisconnectLabel
 	default:
+		return ""
+	}
+}
+
+func ItemMarshalJSON(item Item) ([]byte, error) {
+	type envelope struct {
+		Type string `json:"type"`
+		Item Item   `json:"item"`
+	}
+
+	label := ItemLabel(item)
+	if label == "" {
 		return nil, nil // it's not important for us to serialize this
 	}
+
+	return json.Marshal(envelope{Type: label, Item: item})
 }
 
 func ItemUnmarshalJSON(payload []byte) (Item, error) {
@@ -130,7 +142,7 @@ type Item interface {
 	GetSessionID() SessionID
 	GetUser() string
 	GetDatabase() string
-	Handle(context.Context, *pgx.Conn) error
+	Handle(context.Context, *pgx.Conn) (pgconn.CommandTag, error)
 }
 
 type Details struct {
@@ -138,6 +150,24 @@ type Details struct {
 	SessionID SessionID `json:"session_id"`
 	User      string    `json:"user"`
 	Database  string    `json:"database"`
+	// Application is the application_name of the session, for logs that record it
+	Application string `json:"application,omitempty"`
+	// Duration is how long the item originally took to execute, for items that were
+	// logged along with their duration
+	Duration time.Duration `json:"duration,omitempty"`
+	// Transaction identifies the explicit transaction the item was part of, if any, once
+	// items have been grouped by GroupTransactions
+	Transaction uint64 `json:"transaction,omitempty"`
+	// FollowsError is set on the first item a session logged after an ERROR, telling us
+	// that the statement before it failed
+	FollowsError bool `json:"follows_error,omitempty"`
+
+	// offset is the position in the source file at which this item was parsed, for
+	// parsers that can track it
+	offset int64
+	// scheduled is when the Streamer released the item for execution, against which we
+	// measure how far behind schedule the replay has fallen
+	scheduled time.Time
 }
 
 func (e Details) GetTimestamp() time.Time { return e.Timestamp }
@@ -145,16 +175,79 @@ func (e Details) GetSessionID() SessionID { return e.SessionID }
 func (e Details) GetUser() string         { return e.User }
 func (e Details) GetDatabase() string     { return e.Database }
 
+func (e Details) application() string           { return e.Application }
+func (e Details) loggedDuration() time.Duration { return e.Duration }
+func (e Details) transaction() uint64           { return e.Transaction }
+func (e Details) sourceOffset() int64           { return e.offset }
+func (e *Details) setSourceOffset(offset int64) { e.offset = offset }
+func (e Details) scheduledAt() time.Time        { return e.scheduled }
+func (e Details) followsError() bool            { return e.FollowsError }
+
+// SourceOffset returns the byte offset the item was parsed from, or zero if unknown
+func SourceOffset(item Item) int64 {
+	if positioned, ok := item.(interface{ sourceOffset() int64 }); ok {
+		return positioned.sourceOffset()
+	}
+
+	return 0
+}
+
+// scheduledAt returns when the Streamer released the item, or the zero time if it hasn't
+func scheduledAt(item Item) time.Time {
+	if scheduled, ok := item.(interface{ scheduledAt() time.Time }); ok {
+		return scheduled.scheduledAt()
+	}
+
+	return time.Time{}
+}
+
+// setSourceOffset records where we parsed the item from, which is only possible for the
+// pointer items we construct when unmarshalling JSON.
+func setSourceOffset(item Item, offset int64) {
+	if positioned, ok := item.(interface{ setSourceOffset(int64) }); ok {
+		positioned.setSourceOffset(offset)
+	}
+}
+
+// mapDetails returns a copy of the item with its Details transformed by fn. Items parsed
+// from JSON are pointers, which we copy so as not to modify the original.
+func mapDetails(item Item, fn func(Details) Details) Item {
+	switch item := item.(type) {
+	case Connect:
+		item.Details = fn(item.Details)
+		return item
+	case *Connect:
+		return mapDetails(*item, fn)
+	case Disconnect:
+		item.Details = fn(item.Details)
+		return item
+	case *Disconnect:
+		return mapDetails(*item, fn)
+	case Statement:
+		item.Details = fn(item.Details)
+		return item
+	case *Statement:
+		return mapDetails(*item, fn)
+	case BoundExecute:
+		item.Details = fn(item.Details)
+		return item
+	case *BoundExecute:
+		return mapDetails(*item, fn)
+	default:
+		return item
+	}
+}
+
 type Connect struct{ Details }
 
-func (Connect) Handle(context.Context, *pgx.Conn) error {
-	return nil // Database will manage opening connections
+func (Connect) Handle(context.Context, *pgx.Conn) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, nil // Database opens the connection when this is dispatched
 }
 
 type Disconnect struct{ Details }
 
-func (Disconnect) Handle(ctx context.Context, conn *pgx.Conn) error {
-	return conn.Close(ctx)
+func (Disconnect) Handle(ctx context.Context, conn *pgx.Conn) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, conn.Close(ctx)
 }
 
 type Statement struct {
@@ -162,9 +255,8 @@ type Statement struct {
 	Query string `json:"query"`
 }
 
-func (s Statement) Handle(ctx context.Context, conn *pgx.Conn) error {
-	_, err := conn.Exec(ctx, s.Query)
-	return err
+func (s Statement) Handle(ctx context.Context, conn *pgx.Conn) (pgconn.CommandTag, error) {
+	return conn.Exec(ctx, s.Query)
 }
 
 // Execute is parsed and awaiting arguments. It deliberately lacks a Handle method as it
@@ -189,7 +281,6 @@ type BoundExecute struct {
 	Parameters []interface{} `json:"parameters"`
 }
 
-func (e BoundExecute) Handle(ctx context.Context, conn *pgx.Conn) error {
-	_, err := conn.Exec(ctx, e.Query, e.Parameters...)
-	return err
+func (e BoundExecute) Handle(ctx context.Context, conn *pgx.Conn) (pgconn.CommandTag, error) {
+	return conn.Exec(ctx, e.Query, e.Parameters...)
 }